@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/kaytu-io/kaytu-agent/config"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Manage the schema version of the agent database",
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply the pending migrations",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withAgentDatabase(cmd, func(db *database.AgentDatabase) error {
+			return db.MigrateUp(cmd.Context())
+		})
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Revert the latest applied migrations",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		steps, err := cmd.Flags().GetInt("steps")
+		if err != nil {
+			return err
+		}
+		if steps < 1 {
+			return fmt.Errorf("steps must be at least 1")
+		}
+		return withAgentDatabase(cmd, func(db *database.AgentDatabase) error {
+			return db.MigrateDown(cmd.Context(), steps)
+		})
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "List the migrations and whether they are applied",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withAgentDatabase(cmd, func(db *database.AgentDatabase) error {
+			statuses, err := db.MigrationStatus(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+			for _, status := range statuses {
+				appliedAt := "pending"
+				if status.AppliedAt != nil {
+					appliedAt = status.AppliedAt.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+			}
+			return w.Flush()
+		})
+	},
+}
+
+// withAgentDatabase opens the agent database without migrating it and closes it once fn returns
+func withAgentDatabase(cmd *cobra.Command, fn func(db *database.AgentDatabase) error) error {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+
+	cfg := config.Provide(nil, config.DefaultConfig)
+	db, err := database.OpenAgentDatabase(cmd.Context(), logger, &cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return fn(db)
+}
+
+func init() {
+	migrateDownCmd.Flags().Int("steps", 1, "number of migrations to revert")
+	migrateCmd.AddCommand(migrateUpCmd, migrateDownCmd, migrateStatusCmd)
+	rootCmd.AddCommand(migrateCmd)
+}
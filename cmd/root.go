@@ -1,26 +1,42 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/kaytu-io/kaytu-agent/config"
 	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"github.com/kaytu-io/kaytu-agent/pkg/events"
 	kaytuCmd "github.com/kaytu-io/kaytu-agent/pkg/kaytu/cmd"
+	"github.com/kaytu-io/kaytu-agent/pkg/leader"
 	"github.com/kaytu-io/kaytu-agent/pkg/proto/src/golang"
+	"github.com/kaytu-io/kaytu-agent/pkg/report"
 	"github.com/kaytu-io/kaytu-agent/pkg/scheduler"
 	"github.com/kaytu-io/kaytu-agent/pkg/server"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"k8s.io/client-go/kubernetes"
 	"math"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sync"
+	"syscall"
 )
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use: "kaytu-agent",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		ctx := cmd.Context()
+		// the scheduler loops, health checks and workers stop once a termination signal arrives
+		ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
 
 		logger, err := zap.NewProduction()
 		if err != nil {
@@ -31,12 +47,15 @@ var rootCmd = &cobra.Command{
 		cfg := config.Provide(nil, config.DefaultConfig)
 
 		db, err := database.NewAgentDatabase(ctx, logger, &cfg)
-		defer db.Close()
 		if err != nil {
 			logger.Error("failed to open db", zap.Error(err))
 			return err
 		}
-		optimizationJobsRepo := database.NewOptimizationJobsRepo(db, logger)
+		defer db.Close()
+		jobEvents := events.NewBus[database.OptimizationJob]()
+		optimizationJobsRepo := database.NewOptimizationJobsRepo(db, logger, jobEvents)
+		commandSchedulesRepo := database.NewCommandSchedulesRepo(db, logger)
+		reportsRepo := database.NewReportsRepo(db, logger)
 
 		logger.Info(fmt.Sprintf("listening on :%d", cfg.GrpcPort))
 		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.GrpcPort))
@@ -47,21 +66,155 @@ var rootCmd = &cobra.Command{
 		logger.Info("checking kaytu installation")
 		kc := kaytuCmd.New(logger, &cfg)
 
+		reports := report.New(logger, &cfg, reportsRepo)
+		if err := reports.ImportFiles(ctx); err != nil {
+			logger.Error("failed to import reports from the output directory", zap.Error(err))
+		}
+
+		janitor := scheduler.NewJanitor(logger, &cfg, db, optimizationJobsRepo, reports)
+
 		logger.Info("starting scheduler")
-		scheduler := scheduler.New(kc, logger, &cfg, optimizationJobsRepo)
-		scheduler.Start(ctx)
+		scheduler := scheduler.New(kc, logger, &cfg, optimizationJobsRepo, commandSchedulesRepo, reports)
+		if err := scheduler.Start(ctx); err != nil {
+			logger.Error("failed to start scheduler", zap.Error(err))
+			return err
+		}
+		go janitor.Run(ctx)
+		// the schedules and the retention of the database belong to a single replica
+		lead := func(ctx context.Context) {
+			scheduler.Lead(ctx)
+			janitor.Lead(ctx)
+		}
+		if cfg.LeaderElection.Enabled {
+			restConfig, err := ctrl.GetConfig()
+			if err != nil {
+				logger.Error("failed to load kubernetes config for leader election", zap.Error(err))
+				return err
+			}
+			clientset, err := kubernetes.NewForConfig(restConfig)
+			if err != nil {
+				logger.Error("failed to create kubernetes client for leader election", zap.Error(err))
+				return err
+			}
+			elector := leader.NewElector(logger, cfg.LeaderElection, cfg.GetInstanceID(), clientset.CoordinationV1())
+			go func() {
+				if err := elector.Run(ctx, lead); err != nil {
+					logger.Error("leader election stopped", zap.Error(err))
+				}
+			}()
+		} else {
+			lead(ctx)
+		}
 
-		grpcServer := grpc.NewServer(
-			grpc.MaxRecvMsgSize(128*1024*1024),
+		if !cfg.Auth.Enabled {
+			logger.Warn("grpc authentication is disabled, any client can trigger jobs and read reports")
+		}
+		authenticator := server.NewAuthenticator(&cfg.Auth)
+		grpcOptions := []grpc.ServerOption{
+			grpc.MaxRecvMsgSize(128 * 1024 * 1024),
 			grpc.MaxSendMsgSize(math.MaxInt),
-		)
-		handler := server.NewAgentServer(&cfg, scheduler)
+			grpc.ChainUnaryInterceptor(authenticator.UnaryInterceptor()),
+			grpc.ChainStreamInterceptor(authenticator.StreamInterceptor()),
+		}
+		var tlsConfig *tls.Config
+		if cfg.TLS.Enabled {
+			tlsConfig, err = server.NewServerTLSConfig(cfg.TLS)
+			if err != nil {
+				logger.Error("failed to load tls config", zap.Error(err))
+				return err
+			}
+			grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		grpcServer := grpc.NewServer(grpcOptions...)
+		handler := server.NewAgentServer(&cfg, scheduler, jobEvents, reports)
 		golang.RegisterAgentServer(grpcServer, handler)
+
+		healthChecker := server.NewHealthChecker(logger, db, scheduler, kc)
+		healthpb.RegisterHealthServer(grpcServer, healthChecker.Server())
+		go healthChecker.Run(ctx, cfg.GetHealthCheckInterval())
+
+		if cfg.ReflectionEnabled {
+			reflection.Register(grpcServer)
+		}
+
+		var httpServer *http.Server
+		if cfg.HttpPort != 0 {
+			httpServer = &http.Server{
+				Addr:      fmt.Sprintf(":%d", cfg.HttpPort),
+				Handler:   server.NewGateway(logger, handler, authenticator).Handler(),
+				TLSConfig: tlsConfig,
+			}
+			go func() {
+				logger.Info(fmt.Sprintf("http gateway listening on :%d", cfg.HttpPort))
+				var err error
+				if tlsConfig != nil {
+					err = httpServer.ListenAndServeTLS("", "")
+				} else {
+					err = httpServer.ListenAndServe()
+				}
+				if err != nil && err != http.ErrServerClosed {
+					logger.Error("http gateway stopped", zap.Error(err))
+				}
+			}()
+		}
+
 		logger.Info("starting grpc server")
-		return grpcServer.Serve(lis)
+		serveErr := make(chan error, 1)
+		go func() {
+			serveErr <- grpcServer.Serve(lis)
+		}()
+
+		select {
+		case err := <-serveErr:
+			return err
+		case <-ctx.Done():
+		}
+
+		logger.Info("shutting down", zap.Duration("timeout", cfg.GetShutdownTimeout()))
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.GetShutdownTimeout())
+		defer cancel()
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopGrpcServer(shutdownCtx, grpcServer)
+		}()
+		if httpServer != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := httpServer.Shutdown(shutdownCtx); err != nil {
+					logger.Error("failed to shut down http gateway", zap.Error(err))
+				}
+			}()
+		}
+
+		err = scheduler.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Error("failed to shut down scheduler", zap.Error(err))
+		}
+		wg.Wait()
+		logger.Info("agent stopped")
+		return err
 	},
 }
 
+// stopGrpcServer lets in flight calls finish until ctx is done, open streams such as WatchJobs are closed after that
+func stopGrpcServer(ctx context.Context, grpcServer *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcServer.Stop()
+	}
+}
+
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
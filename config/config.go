@@ -1,13 +1,40 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
 const ConfigDirectory = "/config"
 
+const (
+	// OrphanedJobPolicyRequeue puts jobs that were running when the agent stopped back in the queue
+	OrphanedJobPolicyRequeue = "requeue"
+	// OrphanedJobPolicyInterrupt marks jobs that were running when the agent stopped as INTERRUPTED
+	OrphanedJobPolicyInterrupt = "interrupt"
+)
+
+const (
+	// ReportStorageDatabase keeps reports compressed in the agent database, next to the job that produced them
+	ReportStorageDatabase = "database"
+	// ReportStorageFilesystem keeps reports as json files in the output directory
+	ReportStorageFilesystem = "filesystem"
+)
+
+const (
+	ReportCompressionZstd = "zstd"
+	ReportCompressionGzip = "gzip"
+)
+
+const (
+	DatabaseDialectSQLite   = "sqlite"
+	DatabaseDialectPostgres = "postgres"
+)
+
 type PrometheusConfig struct {
 	Address string `json:"address" yaml:"address" koanf:"address"`
 
@@ -26,15 +53,158 @@ type KaytuConfig struct {
 	ApiKey            string           `json:"apiKey" yaml:"apiKey" koanf:"api_key"`
 }
 
+type TLSConfig struct {
+	Enabled  bool   `json:"enabled" yaml:"enabled" koanf:"enabled"`
+	CertFile string `json:"certFile" yaml:"certFile" koanf:"cert_file"`
+	KeyFile  string `json:"keyFile" yaml:"keyFile" koanf:"key_file"`
+
+	// ClientCAFile enables verifying client certificates against the given CA bundle
+	ClientCAFile      string `json:"clientCAFile" yaml:"clientCAFile" koanf:"client_ca_file"`
+	RequireClientCert bool   `json:"requireClientCert" yaml:"requireClientCert" koanf:"require_client_cert"`
+}
+
+type AuthConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled" koanf:"enabled"`
+	// ReadKeys may only call the read-only RPCs while WriteKeys may call all of them
+	ReadKeys  []string `json:"readKeys" yaml:"readKeys" koanf:"read_keys"`
+	WriteKeys []string `json:"writeKeys" yaml:"writeKeys" koanf:"write_keys"`
+}
+
+// LeaderElectionConfig lets several replicas share storage, only the holder of the kubernetes Lease schedules jobs
+type LeaderElectionConfig struct {
+	Enabled   bool   `json:"enabled" yaml:"enabled" koanf:"enabled"`
+	LeaseName string `json:"leaseName" yaml:"leaseName" koanf:"lease_name"`
+	// LeaseNamespace defaults to the namespace of the pod
+	LeaseNamespace string `json:"leaseNamespace" yaml:"leaseNamespace" koanf:"lease_namespace"`
+
+	LeaseDurationSeconds int64 `json:"leaseDurationSeconds" yaml:"leaseDurationSeconds" koanf:"lease_duration_seconds"`
+	RenewDeadlineSeconds int64 `json:"renewDeadlineSeconds" yaml:"renewDeadlineSeconds" koanf:"renew_deadline_seconds"`
+	RetryPeriodSeconds   int64 `json:"retryPeriodSeconds" yaml:"retryPeriodSeconds" koanf:"retry_period_seconds"`
+}
+
+// DatabaseConfig selects where the agent keeps its jobs, agents sharing a PostgreSQL database share the job queue
+type DatabaseConfig struct {
+	// DSN is either a postgres:// url or key=value connection string selecting PostgreSQL, or the path of a SQLite
+	// file. It defaults to a SQLite file in the working directory.
+	DSN string `json:"dsn" yaml:"dsn" koanf:"dsn"`
+}
+
+// RetentionConfig bounds the history the agent keeps, the janitor applies it every IntervalSeconds.
+// A zero value disables the policy.
+type RetentionConfig struct {
+	IntervalSeconds int64 `json:"intervalSeconds" yaml:"intervalSeconds" koanf:"interval_seconds"`
+	// KeepJobsPerCommand is how many finished jobs are kept per command, older ones are deleted with their reports
+	KeepJobsPerCommand int `json:"keepJobsPerCommand" yaml:"keepJobsPerCommand" koanf:"keep_jobs_per_command"`
+	// MaxJobAgeDays deletes finished jobs created longer ago, with their reports
+	MaxJobAgeDays int `json:"maxJobAgeDays" yaml:"maxJobAgeDays" koanf:"max_job_age_days"`
+	// MaxOutputDirectoryMB caps the size of the output directory, the oldest reports in the history are deleted first
+	MaxOutputDirectoryMB int64 `json:"maxOutputDirectoryMB" yaml:"maxOutputDirectoryMB" koanf:"max_output_directory_mb"`
+	// DeleteOrphanedFiles deletes the partial reports and temporary files that crashed runs left behind
+	DeleteOrphanedFiles bool `json:"deleteOrphanedFiles" yaml:"deleteOrphanedFiles" koanf:"delete_orphaned_files"`
+	// VacuumIntervalSeconds is how often a SQLite database is vacuumed to give the space of deleted rows back
+	VacuumIntervalSeconds int64 `json:"vacuumIntervalSeconds" yaml:"vacuumIntervalSeconds" koanf:"vacuum_interval_seconds"`
+}
+
+func (c RetentionConfig) GetInterval() time.Duration {
+	return time.Duration(max(c.IntervalSeconds, 1)) * time.Second
+}
+
+func (c RetentionConfig) GetVacuumInterval() time.Duration {
+	return time.Duration(c.VacuumIntervalSeconds) * time.Second
+}
+
+func (c RetentionConfig) GetMaxOutputDirectoryBytes() int64 {
+	return c.MaxOutputDirectoryMB * 1024 * 1024
+}
+
+// defaultPlugin provides the commands that do not name a plugin
+const defaultPlugin = "kubernetes"
+
+type CommandConfig struct {
+	// Enabled commands are scheduled and can be triggered, the others are rejected
+	Enabled bool `json:"enabled" yaml:"enabled" koanf:"enabled"`
+	// Schedule is a cron expression, commands without one run every OptimizationJobScheduleIntervalSeconds
+	Schedule string `json:"schedule" yaml:"schedule" koanf:"schedule"`
+	// Timezone is the IANA time zone the schedule is evaluated in, defaults to UTC
+	Timezone string `json:"timezone" yaml:"timezone" koanf:"timezone"`
+	// TimeoutSeconds overrides OptimizationJobRunTimeoutSeconds for the command
+	TimeoutSeconds int64 `json:"timeoutSeconds" yaml:"timeoutSeconds" koanf:"timeout_seconds"`
+	// Plugin is the kaytu plugin providing the command, it is installed when kaytu is initialized
+	Plugin string `json:"plugin" yaml:"plugin" koanf:"plugin"`
+	// ExtraArgs are appended to the arguments of kaytu optimize
+	ExtraArgs []string `json:"extraArgs" yaml:"extraArgs" koanf:"extra_args"`
+}
+
+func (c CommandConfig) GetPlugin() string {
+	if c.Plugin == "" {
+		return defaultPlugin
+	}
+	return c.Plugin
+}
+
 type Config struct {
 	GrpcPort         uint16 `json:"grpcPort" yaml:"grpcPort" koanf:"grpc_port"`
 	WorkingDirectory string `json:"workingDirectory" yaml:"workingDirectory" koanf:"working_directory"`
 
+	// HttpPort serves the http/json gateway, zero disables it
+	HttpPort uint16 `json:"httpPort" yaml:"httpPort" koanf:"http_port"`
+
+	TLS  TLSConfig  `json:"tls" yaml:"tls" koanf:"tls"`
+	Auth AuthConfig `json:"auth" yaml:"auth" koanf:"auth"`
+
+	LeaderElection LeaderElectionConfig `json:"leaderElection" yaml:"leaderElection" koanf:"leader_election"`
+
+	Database DatabaseConfig `json:"database" yaml:"database" koanf:"database"`
+
+	ReflectionEnabled          bool  `json:"reflectionEnabled" yaml:"reflectionEnabled" koanf:"reflection_enabled"`
+	HealthCheckIntervalSeconds int64 `json:"healthCheckIntervalSeconds" yaml:"healthCheckIntervalSeconds" koanf:"health_check_interval_seconds"`
+
 	OptimizationCheckIntervalSeconds       int64 `json:"optimizationCheckIntervalSeconds" yaml:"optimizationCheckIntervalSeconds" koanf:"optimization_check_interval_seconds"`
 	OptimizationJobScheduleIntervalSeconds int64 `json:"optimizationJobScheduleIntervalSeconds" yaml:"optimizationJobScheduleIntervalSeconds" koanf:"optimization_job_schedule_interval_seconds"`
 	OptimizationJobRunTimeoutSeconds       int64 `json:"optimizationJobRunTimeoutSeconds" yaml:"optimizationJobRunTimeoutSeconds" koanf:"optimization_job_run_timeout_seconds"`
 	OptimizationJobQueueTimeoutSeconds     int64 `json:"optimizationJobQueueTimeoutSeconds" yaml:"optimizationJobQueueTimeoutSeconds" koanf:"optimization_job_queue_timeout_seconds"`
 
+	// OptimizationJobMaxAttempts is how many times a job runs before a retryable failure is final
+	OptimizationJobMaxAttempts           int   `json:"optimizationJobMaxAttempts" yaml:"optimizationJobMaxAttempts" koanf:"optimization_job_max_attempts"`
+	OptimizationJobRetryBaseDelaySeconds int64 `json:"optimizationJobRetryBaseDelaySeconds" yaml:"optimizationJobRetryBaseDelaySeconds" koanf:"optimization_job_retry_base_delay_seconds"`
+	OptimizationJobRetryMaxDelaySeconds  int64 `json:"optimizationJobRetryMaxDelaySeconds" yaml:"optimizationJobRetryMaxDelaySeconds" koanf:"optimization_job_retry_max_delay_seconds"`
+
+	// InstanceID identifies this agent as the owner of the jobs it claims, it defaults to the hostname
+	InstanceID string `json:"instanceId" yaml:"instanceId" koanf:"instance_id"`
+	// OptimizationJobHeartbeatIntervalSeconds is how often a running job renews its lease, a job whose lease is not
+	// renewed for OptimizationJobLeaseTimeoutSeconds is considered lost
+	OptimizationJobHeartbeatIntervalSeconds int64 `json:"optimizationJobHeartbeatIntervalSeconds" yaml:"optimizationJobHeartbeatIntervalSeconds" koanf:"optimization_job_heartbeat_interval_seconds"`
+	OptimizationJobLeaseTimeoutSeconds      int64 `json:"optimizationJobLeaseTimeoutSeconds" yaml:"optimizationJobLeaseTimeoutSeconds" koanf:"optimization_job_lease_timeout_seconds"`
+
+	// ShutdownTimeoutSeconds is how long running jobs may finish after a termination signal before they are killed
+	ShutdownTimeoutSeconds int64 `json:"shutdownTimeoutSeconds" yaml:"shutdownTimeoutSeconds" koanf:"shutdown_timeout_seconds"`
+	// OrphanedJobPolicy is either requeue or interrupt and applies to jobs killed on shutdown or left in progress by a crash
+	OrphanedJobPolicy string `json:"orphanedJobPolicy" yaml:"orphanedJobPolicy" koanf:"orphaned_job_policy"`
+
+	// OptimizationWorkerCount is how many optimization jobs run at the same time, at most one per command
+	OptimizationWorkerCount int `json:"optimizationWorkerCount" yaml:"optimizationWorkerCount" koanf:"optimization_worker_count"`
+	// PrometheusConcurrency is how many of the running jobs may query prometheus at once
+	PrometheusConcurrency int `json:"prometheusConcurrency" yaml:"prometheusConcurrency" koanf:"prometheus_concurrency"`
+
+	// DeriveSubReports only schedules the aggregate kubernetes command and splits its report by workload kind
+	// into the reports of the single-kind commands, instead of scheduling each of them. The single-kind commands
+	// cannot have a schedule of their own then.
+	DeriveSubReports bool `json:"deriveSubReports" yaml:"deriveSubReports" koanf:"derive_sub_reports"`
+
+	// Commands is the registry of the commands the agent runs, keyed by the command name
+	Commands map[string]CommandConfig `json:"commands" yaml:"commands" koanf:"commands"`
+
+	// ReportRetentionCount is how many past reports are kept per command, zero or less keeps all of them
+	ReportRetentionCount int `json:"reportRetentionCount" yaml:"reportRetentionCount" koanf:"report_retention_count"`
+
+	// ReportStorage is either database or filesystem. An agent switching to the database imports the reports it finds
+	// in the output directory for the commands that have none in the database yet.
+	ReportStorage string `json:"reportStorage" yaml:"reportStorage" koanf:"report_storage"`
+	// ReportCompression is either zstd or gzip, it applies to reports stored in the database
+	ReportCompression string `json:"reportCompression" yaml:"reportCompression" koanf:"report_compression"`
+
+	Retention RetentionConfig `json:"retention" yaml:"retention" koanf:"retention"`
+
 	KaytuConfig KaytuConfig `json:"kaytuConfig" yaml:"kaytuConfig" koanf:"kaytu_config"`
 }
 
@@ -44,11 +214,54 @@ var DefaultConfig = Config{
 	GrpcPort:         8001,
 	WorkingDirectory: filepath.Join(userHomeDir, ".kaytu", "agent"),
 
+	HealthCheckIntervalSeconds: 10,
+
+	LeaderElection: LeaderElectionConfig{
+		LeaseName:            "kaytu-agent",
+		LeaseDurationSeconds: 15,
+		RenewDeadlineSeconds: 10,
+		RetryPeriodSeconds:   2,
+	},
+
 	OptimizationCheckIntervalSeconds:       60,
 	OptimizationJobScheduleIntervalSeconds: 86400,
 	OptimizationJobRunTimeoutSeconds:       7200,
 	OptimizationJobQueueTimeoutSeconds:     86400,
 
+	OptimizationJobMaxAttempts:           3,
+	OptimizationJobRetryBaseDelaySeconds: 60,
+	OptimizationJobRetryMaxDelaySeconds:  3600,
+
+	OptimizationJobHeartbeatIntervalSeconds: 30,
+	OptimizationJobLeaseTimeoutSeconds:      180,
+
+	ShutdownTimeoutSeconds: 25,
+	OrphanedJobPolicy:      OrphanedJobPolicyRequeue,
+
+	OptimizationWorkerCount: 1,
+	PrometheusConcurrency:   2,
+
+	Commands: map[string]CommandConfig{
+		"kubernetes-pods":         {Enabled: true, Plugin: defaultPlugin},
+		"kubernetes-deployments":  {Enabled: true, Plugin: defaultPlugin},
+		"kubernetes-statefulsets": {Enabled: true, Plugin: defaultPlugin},
+		"kubernetes-daemonsets":   {Enabled: true, Plugin: defaultPlugin},
+		"kubernetes-jobs":         {Enabled: true, Plugin: defaultPlugin},
+		"kubernetes":              {Enabled: true, Plugin: defaultPlugin},
+	},
+
+	ReportRetentionCount: 30,
+	ReportStorage:        ReportStorageDatabase,
+	ReportCompression:    ReportCompressionZstd,
+
+	Retention: RetentionConfig{
+		IntervalSeconds:       3600,
+		KeepJobsPerCommand:    500,
+		MaxJobAgeDays:         90,
+		DeleteOrphanedFiles:   true,
+		VacuumIntervalSeconds: 604800,
+	},
+
 	KaytuConfig: KaytuConfig{
 		ObservabilityDays: 14,
 		Prometheus:        PrometheusConfig{},
@@ -61,10 +274,99 @@ func (c Config) GetOutputDirectory() string {
 	return filepath.Join(c.WorkingDirectory, "output")
 }
 
+func (c Config) GetReportHistoryDirectory(command string) string {
+	return filepath.Join(c.GetOutputDirectory(), command)
+}
+
+func (c Config) GetWorkersDirectory() string {
+	return filepath.Join(c.WorkingDirectory, "workers")
+}
+
+// GetWorkerDirectory is the working directory of a single optimization worker
+func (c Config) GetWorkerDirectory(worker int) string {
+	return filepath.Join(c.GetWorkersDirectory(), fmt.Sprintf("%d", worker))
+}
+
+// GetCommandNames returns the enabled commands sorted by name
+func (c Config) GetCommandNames() []string {
+	var names []string
+	for name, command := range c.Commands {
+		if command.Enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetCommand returns the settings of the command if it is enabled
+func (c Config) GetCommand(name string) (CommandConfig, bool) {
+	command, ok := c.Commands[name]
+	if !ok || !command.Enabled {
+		return CommandConfig{}, false
+	}
+	return command, true
+}
+
+// GetPlugins returns the plugins the enabled commands need, sorted by name
+func (c Config) GetPlugins() []string {
+	seen := make(map[string]bool)
+	var plugins []string
+	for _, name := range c.GetCommandNames() {
+		plugin := c.Commands[name].GetPlugin()
+		if !seen[plugin] {
+			seen[plugin] = true
+			plugins = append(plugins, plugin)
+		}
+	}
+	sort.Strings(plugins)
+	return plugins
+}
+
+func (c Config) GetOptimizationWorkerCount() int {
+	return max(c.OptimizationWorkerCount, 1)
+}
+
+func (c Config) GetPrometheusConcurrency() int {
+	return max(c.PrometheusConcurrency, 1)
+}
+
+// StoresReportsInDatabase tells whether reports are kept in the agent database rather than in the output directory
+func (c Config) StoresReportsInDatabase() bool {
+	return c.ReportStorage != ReportStorageFilesystem
+}
+
+func (c Config) GetReportCompression() string {
+	if c.ReportCompression == ReportCompressionGzip {
+		return ReportCompressionGzip
+	}
+	return ReportCompressionZstd
+}
+
 func (c Config) GetDBFilePath() string {
 	return filepath.Join(c.WorkingDirectory, "agent-sqlite.db")
 }
 
+// GetDatabaseDialect tells from the DSN whether the agent database is PostgreSQL or SQLite
+func (c Config) GetDatabaseDialect() string {
+	dsn := c.Database.DSN
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") || strings.Contains(dsn, "host=") {
+		return DatabaseDialectPostgres
+	}
+	return DatabaseDialectSQLite
+}
+
+func (c Config) GetDatabaseDSN() string {
+	if c.Database.DSN == "" {
+		return c.GetDBFilePath()
+	}
+	return c.Database.DSN
+}
+
+func (c Config) GetHealthCheckInterval() time.Duration {
+	return time.Duration(c.HealthCheckIntervalSeconds) * time.Second
+}
+
 func (c Config) GetOptimizationCheckInterval() time.Duration {
 	return time.Duration(c.OptimizationCheckIntervalSeconds) * time.Second
 }
@@ -77,6 +379,83 @@ func (c Config) GetOptimizationJobRunTimeout() time.Duration {
 	return time.Duration(c.OptimizationJobRunTimeoutSeconds) * time.Second
 }
 
+// GetCommandRunTimeout is the run timeout of the command, it falls back to the global run timeout
+func (c Config) GetCommandRunTimeout(command string) time.Duration {
+	if timeout := c.Commands[command].TimeoutSeconds; timeout > 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	return c.GetOptimizationJobRunTimeout()
+}
+
+// GetLongestRunTimeout is the longest any command may run
+func (c Config) GetLongestRunTimeout() time.Duration {
+	timeout := c.GetOptimizationJobRunTimeout()
+	for name := range c.Commands {
+		timeout = max(timeout, c.GetCommandRunTimeout(name))
+	}
+	return timeout
+}
+
 func (c Config) GetOptimizationJobQueueTimeout() time.Duration {
 	return time.Duration(c.OptimizationJobQueueTimeoutSeconds) * time.Second
 }
+
+func (c Config) GetOptimizationJobMaxAttempts() int {
+	return max(c.OptimizationJobMaxAttempts, 1)
+}
+
+func (c Config) GetOptimizationJobRetryBaseDelay() time.Duration {
+	return time.Duration(c.OptimizationJobRetryBaseDelaySeconds) * time.Second
+}
+
+func (c Config) GetOptimizationJobRetryMaxDelay() time.Duration {
+	return time.Duration(c.OptimizationJobRetryMaxDelaySeconds) * time.Second
+}
+
+// GetInstanceID falls back to the hostname, so an agent restarted in the same pod recognizes the jobs it owned
+func (c Config) GetInstanceID() string {
+	if c.InstanceID != "" {
+		return c.InstanceID
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "kaytu-agent"
+	}
+	return hostname
+}
+
+func (c Config) GetOptimizationJobHeartbeatInterval() time.Duration {
+	return time.Duration(max(c.OptimizationJobHeartbeatIntervalSeconds, 1)) * time.Second
+}
+
+func (c Config) GetOptimizationJobLeaseTimeout() time.Duration {
+	return time.Duration(c.OptimizationJobLeaseTimeoutSeconds) * time.Second
+}
+
+func (c Config) GetShutdownTimeout() time.Duration {
+	return time.Duration(c.ShutdownTimeoutSeconds) * time.Second
+}
+
+// GetLeaseNamespace falls back to the namespace of the service account the agent runs with
+func (c LeaderElectionConfig) GetLeaseNamespace() string {
+	if c.LeaseNamespace != "" {
+		return c.LeaseNamespace
+	}
+	namespace, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil || strings.TrimSpace(string(namespace)) == "" {
+		return "default"
+	}
+	return strings.TrimSpace(string(namespace))
+}
+
+func (c LeaderElectionConfig) GetLeaseDuration() time.Duration {
+	return time.Duration(c.LeaseDurationSeconds) * time.Second
+}
+
+func (c LeaderElectionConfig) GetRenewDeadline() time.Duration {
+	return time.Duration(c.RenewDeadlineSeconds) * time.Second
+}
+
+func (c LeaderElectionConfig) GetRetryPeriod() time.Duration {
+	return time.Duration(c.RetryPeriodSeconds) * time.Second
+}
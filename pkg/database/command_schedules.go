@@ -0,0 +1,48 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// CommandSchedule keeps when a command was last enqueued by the scheduler and when it is due next,
+// so restarts neither skip nor repeat a scheduled run.
+type CommandSchedule struct {
+	Command string `json:"command" gorm:"primaryKey"`
+	// Schedule is the schedule NextFireAt was computed with, a changed schedule recomputes it
+	Schedule   string     `json:"schedule"`
+	LastFireAt *time.Time `json:"lastFireAt"`
+	NextFireAt time.Time  `json:"nextFireAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+}
+
+type CommandSchedulesRepo interface {
+	GetCommandSchedule(ctx context.Context, command string) (*CommandSchedule, error)
+	SaveCommandSchedule(ctx context.Context, schedule *CommandSchedule) error
+}
+
+type CommandSchedulesRepoImpl struct {
+	db     *gorm.DB
+	logger *zap.Logger
+}
+
+func NewCommandSchedulesRepo(db *AgentDatabase, logger *zap.Logger) *CommandSchedulesRepoImpl {
+	return &CommandSchedulesRepoImpl{db: db.db, logger: logger}
+}
+
+func (r *CommandSchedulesRepoImpl) GetCommandSchedule(ctx context.Context, command string) (*CommandSchedule, error) {
+	schedule := &CommandSchedule{}
+	err := r.db.WithContext(ctx).Where("command = ?", command).First(schedule).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return schedule, err
+}
+
+func (r *CommandSchedulesRepoImpl) SaveCommandSchedule(ctx context.Context, schedule *CommandSchedule) error {
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(schedule).Error
+}
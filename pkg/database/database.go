@@ -5,27 +5,44 @@ import (
 	"github.com/glebarez/sqlite"
 	"github.com/kaytu-io/kaytu-agent/config"
 	"go.uber.org/zap"
+	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	glogger "gorm.io/gorm/logger"
 	"moul.io/zapgorm2"
 	"os"
+	"path/filepath"
 	"time"
 )
 
 type AgentDatabase struct {
-	db *gorm.DB
+	db     *gorm.DB
+	logger *zap.Logger
 }
 
+// NewAgentDatabase opens the agent database and applies the pending migrations
 func NewAgentDatabase(ctx context.Context, logger *zap.Logger, cfg *config.Config) (*AgentDatabase, error) {
-	if _, err := os.Stat(cfg.GetDBFilePath()); err != nil && os.IsNotExist(err) {
-		_ = os.MkdirAll(cfg.WorkingDirectory, os.ModePerm)
+	db, err := OpenAgentDatabase(ctx, logger, cfg)
+	if err != nil {
+		return nil, err
 	}
 
+	err = db.MigrateUp(ctx)
+	if err != nil {
+		logger.Error("failed to migrate db", zap.Error(err))
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// OpenAgentDatabase opens the agent database as it is, without migrating it
+func OpenAgentDatabase(ctx context.Context, logger *zap.Logger, cfg *config.Config) (*AgentDatabase, error) {
 	gormLogger := zapgorm2.New(logger)
 	gormLogger.IgnoreRecordNotFoundError = true
 	gormLogger.SlowThreshold = time.Second
 
-	db, err := gorm.Open(sqlite.Open(cfg.GetDBFilePath()), &gorm.Config{
+	db, err := gorm.Open(openDialector(cfg), &gorm.Config{
 		Logger: gormLogger.LogMode(glogger.Warn),
 	})
 	if err != nil {
@@ -33,15 +50,64 @@ func NewAgentDatabase(ctx context.Context, logger *zap.Logger, cfg *config.Confi
 		return nil, err
 	}
 
-	err = db.AutoMigrate(&OptimizationJob{})
+	return &AgentDatabase{
+		db:     db,
+		logger: logger,
+	}, nil
+}
+
+// openDialector picks the gorm dialect from the DSN, SQLite stays the default
+func openDialector(cfg *config.Config) gorm.Dialector {
+	if cfg.GetDatabaseDialect() == config.DatabaseDialectPostgres {
+		return postgres.Open(cfg.GetDatabaseDSN())
+	}
+
+	dsn := cfg.GetDatabaseDSN()
+	if _, err := os.Stat(dsn); err != nil && os.IsNotExist(err) {
+		_ = os.MkdirAll(filepath.Dir(dsn), os.ModePerm)
+	}
+	return sqlite.Open(dsn)
+}
+
+func (d *AgentDatabase) Ping(ctx context.Context) error {
+	sqlDB, err := d.db.DB()
 	if err != nil {
-		logger.Error("failed to auto migrate", zap.Error(err))
-		return nil, err
+		return err
 	}
 
-	return &AgentDatabase{
-		db: db,
-	}, nil
+	return sqlDB.PingContext(ctx)
+}
+
+// MaintenanceRun records when a maintenance task last ran, so its interval holds across restarts of the agent
+type MaintenanceRun struct {
+	Name  string `gorm:"primaryKey"`
+	RanAt time.Time
+}
+
+// maintenanceVacuum is the maintenance run of Vacuum
+const maintenanceVacuum = "vacuum"
+
+// Vacuum rebuilds a SQLite database to give the space of deleted rows back to the filesystem and records when it did,
+// PostgreSQL vacuums on its own
+func (d *AgentDatabase) Vacuum(ctx context.Context) error {
+	if d.db.Dialector.Name() != config.DatabaseDialectSQLite {
+		return nil
+	}
+	// VACUUM can't run inside a transaction, so the run is recorded once it is done
+	if err := d.db.WithContext(ctx).Exec("VACUUM").Error; err != nil {
+		return err
+	}
+	return d.db.WithContext(ctx).Save(&MaintenanceRun{Name: maintenanceVacuum, RanAt: time.Now()}).Error
+}
+
+// LastVacuum returns when Vacuum last ran, or nil if it never did
+func (d *AgentDatabase) LastVacuum(ctx context.Context) (*time.Time, error) {
+	var runs []MaintenanceRun
+	err := d.db.WithContext(ctx).Where("name = ?", maintenanceVacuum).Limit(1).Find(&runs).Error
+	if err != nil || len(runs) == 0 {
+		return nil, err
+	}
+	return &runs[0].RanAt, nil
 }
 
 func (d *AgentDatabase) Close() error {
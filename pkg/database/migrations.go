@@ -0,0 +1,292 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/kaytu-io/kaytu-agent/config"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"sort"
+	"time"
+)
+
+// Migration changes the schema from the previous version to Version. Up and Down only use the gorm migrator and
+// portable SQL so they run on every dialect, and they refer to frozen copies of the models rather than the models
+// themselves, so changing a model later does not change what an old migration did.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// migrations are applied in order, a released migration is never edited, a new one is appended instead
+var migrations = []Migration{
+	{
+		// databases created with AutoMigrate before the schema was versioned already have the tables, creating
+		// them is a no-op there and the database is adopted at this version
+		Version: 1,
+		Name:    "create optimization jobs",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().AutoMigrate(&optimizationJobV1{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&optimizationJobV1{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create command schedules",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().AutoMigrate(&commandScheduleV2{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&commandScheduleV2{})
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create reports",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().AutoMigrate(&reportV3{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&reportV3{})
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create optimization job events",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().AutoMigrate(&optimizationJobEventV4{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&optimizationJobEventV4{})
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create maintenance runs",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().AutoMigrate(&maintenanceRunV5{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&maintenanceRunV5{})
+		},
+	},
+}
+
+type optimizationJobV1 struct {
+	gorm.Model
+	Command       string `gorm:"index"`
+	Status        string `gorm:"index"`
+	ErrorMessage  string
+	Priority      int32 `gorm:"index"`
+	TriggerSource string
+	Attempt       int
+	MaxAttempts   int
+	NextAttemptAt *time.Time `gorm:"index"`
+	Owner         string     `gorm:"index"`
+	ClaimedAt     *time.Time
+	HeartbeatAt   *time.Time `gorm:"index"`
+	Parameters    string
+	ParentJobID   *uint `gorm:"index"`
+}
+
+func (optimizationJobV1) TableName() string { return "optimization_jobs" }
+
+type commandScheduleV2 struct {
+	Command    string `gorm:"primaryKey"`
+	Schedule   string
+	LastFireAt *time.Time
+	NextFireAt time.Time
+	UpdatedAt  time.Time
+}
+
+func (commandScheduleV2) TableName() string { return "command_schedules" }
+
+type reportV3 struct {
+	ID                uint               `gorm:"primarykey"`
+	OptimizationJobID uint               `gorm:"uniqueIndex"`
+	OptimizationJob   *optimizationJobV1 `gorm:"constraint:OnDelete:CASCADE"`
+	Command           string             `gorm:"index"`
+	CustomParameters  bool
+	Compression       string
+	Content           []byte
+	Size              int64
+	CompressedSize    int64
+	SHA256            string
+	GeneratedAt       time.Time
+}
+
+func (reportV3) TableName() string { return "reports" }
+
+type optimizationJobEventV4 struct {
+	ID                uint `gorm:"primarykey"`
+	OptimizationJobID uint `gorm:"index"`
+	FromStatus        string
+	ToStatus          string
+	Actor             string
+	Message           string
+	CreatedAt         time.Time `gorm:"index"`
+}
+
+func (optimizationJobEventV4) TableName() string { return "optimization_job_events" }
+
+type maintenanceRunV5 struct {
+	Name  string `gorm:"primaryKey"`
+	RanAt time.Time
+}
+
+func (maintenanceRunV5) TableName() string { return "maintenance_runs" }
+
+// schemaVersion records a migration applied to the database
+type schemaVersion struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaVersion) TableName() string { return "schema_version" }
+
+// MigrationStatus is a migration the agent knows or the database has applied, AppliedAt is nil while it is pending
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// LatestSchemaVersion is the version the schema is at once every migration of this agent is applied
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// MigrateUp applies the pending migrations. It refuses a database that a newer agent already migrated past the
+// migrations this agent knows.
+func (d *AgentDatabase) MigrateUp(ctx context.Context) error {
+	return d.migrate(ctx, func(tx *gorm.DB, applied map[int]schemaVersion) error {
+		for version := range applied {
+			if version > LatestSchemaVersion() {
+				return fmt.Errorf("database schema is at version %d, this agent only supports up to %d", version, LatestSchemaVersion())
+			}
+		}
+
+		for _, migration := range migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			d.logger.Info("applying migration", zap.Int("version", migration.Version), zap.String("name", migration.Name))
+			if err := migration.Up(tx); err != nil {
+				return fmt.Errorf("failed to apply migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+			err := tx.Create(&schemaVersion{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MigrateDown reverts the latest steps applied migrations, newest first
+func (d *AgentDatabase) MigrateDown(ctx context.Context, steps int) error {
+	return d.migrate(ctx, func(tx *gorm.DB, applied map[int]schemaVersion) error {
+		versions := make([]int, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+		if steps < len(versions) {
+			versions = versions[:steps]
+		}
+
+		for _, version := range versions {
+			migration, ok := findMigration(version)
+			if !ok {
+				return fmt.Errorf("migration %d was applied by a newer agent and cannot be reverted by this one", version)
+			}
+			d.logger.Info("reverting migration", zap.Int("version", migration.Version), zap.String("name", migration.Name))
+			if err := migration.Down(tx); err != nil {
+				return fmt.Errorf("failed to revert migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+			if err := tx.Delete(&schemaVersion{}, version).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MigrationStatus lists the known and the applied migrations ordered by version
+func (d *AgentDatabase) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := appliedSchemaVersions(d.db.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, migration := range migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if version, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &version.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	for _, version := range applied {
+		if _, ok := findMigration(version.Version); !ok {
+			statuses = append(statuses, MigrationStatus{Version: version.Version, Name: version.Name, AppliedAt: &version.AppliedAt})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// migrate runs fn in a single transaction, so a failing migration leaves the schema as it was. Agents sharing a
+// PostgreSQL database wait for each other instead of migrating at the same time.
+func (d *AgentDatabase) migrate(ctx context.Context, fn func(tx *gorm.DB, applied map[int]schemaVersion) error) error {
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if tx.Dialector.Name() == config.DatabaseDialectPostgres {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "schema-version").Error; err != nil {
+				return err
+			}
+		}
+		if !tx.Migrator().HasTable(&schemaVersion{}) {
+			if err := tx.Migrator().CreateTable(&schemaVersion{}); err != nil {
+				return err
+			}
+		}
+
+		applied, err := appliedSchemaVersions(tx)
+		if err != nil {
+			return err
+		}
+		return fn(tx, applied)
+	})
+}
+
+func appliedSchemaVersions(tx *gorm.DB) (map[int]schemaVersion, error) {
+	applied := make(map[int]schemaVersion)
+	if !tx.Migrator().HasTable(&schemaVersion{}) {
+		return applied, nil
+	}
+
+	var versions []schemaVersion
+	if err := tx.Find(&versions).Error; err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		applied[version.Version] = version
+	}
+	return applied, nil
+}
+
+func findMigration(version int) (Migration, bool) {
+	for _, migration := range migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+	return Migration{}, false
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"time"
+)
+
+const (
+	// ActorScheduler is the actor of the transitions the agent makes on its own
+	ActorScheduler = "scheduler"
+	// ActorJanitor is the actor of the jobs the retention policies delete
+	ActorJanitor = "janitor"
+)
+
+type actorKey struct{}
+
+// WithActor attributes the job transitions made with ctx to actor in the audit log, they are attributed to the
+// scheduler otherwise
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor WithActor attributed ctx to
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return ActorScheduler
+}
+
+// OptimizationJobEvent records a transition of a job from one status to another. FromStatus is empty for the event
+// that created the job and ToStatus for the event that deleted it.
+type OptimizationJobEvent struct {
+	ID                uint                  `json:"id" gorm:"primarykey"`
+	OptimizationJobID uint                  `json:"optimizationJobId" gorm:"index"`
+	FromStatus        OptimizationJobStatus `json:"fromStatus"`
+	ToStatus          OptimizationJobStatus `json:"toStatus"`
+	Actor             string                `json:"actor"`
+	Message           string                `json:"message"`
+	CreatedAt         time.Time             `json:"createdAt" gorm:"index"`
+}
+
+// recordEvent adds a transition of the job to the audit log, the actor comes from the context of tx
+func recordEvent(tx *gorm.DB, jobID uint, from, to OptimizationJobStatus, message string) error {
+	return tx.Create(&OptimizationJobEvent{
+		OptimizationJobID: jobID,
+		FromStatus:        from,
+		ToStatus:          to,
+		Actor:             ActorFromContext(tx.Statement.Context),
+		Message:           message,
+	}).Error
+}
+
+// OptimizationJobDurations adds up the time a job spent queued and running from its events in the order they
+// happened, a job that is still queued or running counts until now
+func OptimizationJobDurations(events []OptimizationJobEvent, now time.Time) (queueWait time.Duration, runDuration time.Duration) {
+	for idx, event := range events {
+		until := now
+		if idx+1 < len(events) {
+			until = events[idx+1].CreatedAt
+		}
+		switch event.ToStatus {
+		case OptimizationJobStatusCreated:
+			queueWait += until.Sub(event.CreatedAt)
+		case OptimizationJobStatusInProgress:
+			runDuration += until.Sub(event.CreatedAt)
+		}
+	}
+	return queueWait, runDuration
+}
@@ -3,9 +3,13 @@ package database
 import (
 	"context"
 	"errors"
+	"fmt"
+	"github.com/kaytu-io/kaytu-agent/config"
+	"github.com/kaytu-io/kaytu-agent/pkg/events"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
+	"sort"
 	"time"
 )
 
@@ -17,46 +21,221 @@ const (
 	OptimizationJobStatusSucceeded  OptimizationJobStatus = "SUCCEEDED"
 	OptimizationJobStatusFailed     OptimizationJobStatus = "FAILED"
 	OptimizationJobStatusTimeout    OptimizationJobStatus = "TIMEOUT"
+	OptimizationJobStatusCancelled  OptimizationJobStatus = "CANCELLED"
+	// OptimizationJobStatusInterrupted is a job that was stopped because the agent shut down
+	OptimizationJobStatusInterrupted OptimizationJobStatus = "INTERRUPTED"
 )
 
+func (s OptimizationJobStatus) IsValid() bool {
+	switch s {
+	case OptimizationJobStatusCreated, OptimizationJobStatusInProgress, OptimizationJobStatusSucceeded,
+		OptimizationJobStatusFailed, OptimizationJobStatusTimeout, OptimizationJobStatusCancelled, OptimizationJobStatusInterrupted:
+		return true
+	}
+	return false
+}
+
+type OptimizationJobTriggerSource string
+
+const (
+	OptimizationJobTriggerSourceManual   OptimizationJobTriggerSource = "manual"
+	OptimizationJobTriggerSourceSchedule OptimizationJobTriggerSource = "schedule"
+	OptimizationJobTriggerSourceWebhook  OptimizationJobTriggerSource = "webhook"
+	// OptimizationJobTriggerSourceDerived is a job whose report was split off the report of its parent job
+	OptimizationJobTriggerSourceDerived OptimizationJobTriggerSource = "derived"
+	// OptimizationJobTriggerSourceImport is a job recorded for a report imported from the filesystem
+	OptimizationJobTriggerSourceImport OptimizationJobTriggerSource = "import"
+)
+
+// OptimizationJobParameters override the agent configuration for a single run of a job
+type OptimizationJobParameters struct {
+	ObservabilityDays *int              `json:"observabilityDays,omitempty"`
+	Preferences       map[string]string `json:"preferences,omitempty"`
+	Namespaces        []string          `json:"namespaces,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+}
+
+// IsDefault reports whether the job runs with the agent configuration as is, only such jobs produce the canonical report
+func (p OptimizationJobParameters) IsDefault() bool {
+	return p.ObservabilityDays == nil && len(p.Preferences) == 0 && len(p.Namespaces) == 0 && len(p.Labels) == 0
+}
+
 type OptimizationJob struct {
 	gorm.Model
 	Command      string                `json:"command" gorm:"index"`
 	Status       OptimizationJobStatus `json:"status" gorm:"index"`
 	ErrorMessage string                `json:"errorMessage"`
+
+	// Priority orders the queue, jobs with a higher priority are claimed first and equal ones in creation order
+	Priority      int32                        `json:"priority" gorm:"index"`
+	TriggerSource OptimizationJobTriggerSource `json:"triggerSource"`
+
+	// Attempt counts the runs of the job so far, a failed run is retried until it reaches MaxAttempts
+	Attempt     int `json:"attempt"`
+	MaxAttempts int `json:"maxAttempts"`
+	// NextAttemptAt keeps a retried job in the queue until its backoff has passed
+	NextAttemptAt *time.Time `json:"nextAttemptAt" gorm:"index"`
+
+	// Owner is the instance id of the agent running the job, it holds the job as long as it keeps HeartbeatAt fresh
+	Owner       string     `json:"owner" gorm:"index"`
+	ClaimedAt   *time.Time `json:"claimedAt"`
+	HeartbeatAt *time.Time `json:"heartbeatAt" gorm:"index"`
+
+	Parameters OptimizationJobParameters `json:"parameters" gorm:"serializer:json"`
+	// ParentJobID is the job a derived job took its report from
+	ParentJobID *uint `json:"parentJobId" gorm:"index"`
+}
+
+// finishedOptimizationJobStatuses are the statuses a job does not leave anymore
+var finishedOptimizationJobStatuses = []OptimizationJobStatus{
+	OptimizationJobStatusSucceeded, OptimizationJobStatusFailed, OptimizationJobStatusTimeout,
+	OptimizationJobStatusCancelled, OptimizationJobStatusInterrupted,
+}
+
+// maxClaimAttempts bounds how many jobs a claim tries when other agents keep claiming them, or their commands, first
+const maxClaimAttempts = 5
+
+// OptimizationJobsFilter selects jobs for ListOptimizationJobs, empty fields match everything.
+// Jobs are ordered by id, newest first unless Ascending is set, and AfterID continues a previous listing.
+type OptimizationJobsFilter struct {
+	Commands      []string
+	Statuses      []OptimizationJobStatus
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	AfterID       uint
+	Ascending     bool
+	Limit         int
 }
 
 type OptimizationJobsRepo interface {
-	CreateOptimizationJob(ctx context.Context, command string) error
-	SetOptimizationJobStatus(ctx context.Context, id uint, status OptimizationJobStatus, errorMessage string) error
+	CreateOptimizationJob(ctx context.Context, job *OptimizationJob) error
+	CreateDerivedOptimizationJob(ctx context.Context, job *OptimizationJob, report *Report) error
+	SetOptimizationJobStatus(ctx context.Context, id uint, owner string, status OptimizationJobStatus, errorMessage string) (bool, error)
+	SucceedOptimizationJob(ctx context.Context, id uint, owner string, report *Report) error
 	GetOptimizationJob(ctx context.Context, id uint) (*OptimizationJob, error)
-	GetCreatedOptimizationJobAndSetInProgress(ctx context.Context) (*OptimizationJob, error)
+	GetCreatedOptimizationJobAndSetInProgress(ctx context.Context, owner string) (*OptimizationJob, error)
+	RenewOptimizationJobLease(ctx context.Context, id uint, owner string) (bool, error)
 	GetLatestOptimizationJobByCommand(ctx context.Context, command string) (*OptimizationJob, error)
-	TimeoutOutdatedOptimizationJobs(ctx context.Context, timeout time.Duration) error
+	RetryOptimizationJob(ctx context.Context, id uint, owner string, nextAttemptAt time.Time, errorMessage string) (bool, error)
+	TimeoutOutdatedOptimizationJobs(ctx context.Context, queueTimeout, leaseTimeout time.Duration) error
+	CancelCreatedOptimizationJob(ctx context.Context, id uint) (bool, error)
+	ListOptimizationJobs(ctx context.Context, filter OptimizationJobsFilter) ([]OptimizationJob, error)
+	ListOrphanedOptimizationJobs(ctx context.Context, owner string, leaseTimeout time.Duration) ([]OptimizationJob, error)
+	ListExpiredOptimizationJobs(ctx context.Context, keepPerCommand int, createdBefore time.Time) ([]OptimizationJob, error)
+	DeleteOptimizationJobs(ctx context.Context, ids []uint) error
+	ListOptimizationJobEvents(ctx context.Context, id uint) ([]OptimizationJobEvent, error)
+	DeleteOptimizationJobEvents(ctx context.Context, createdBefore time.Time) error
 }
 
+// OptimizationJobsRepoImpl publishes every job it creates or moves to another status on jobEvents, and records each
+// of these transitions in the optimization_job_events audit log in the same transaction.
 type OptimizationJobsRepoImpl struct {
-	db     *gorm.DB
-	logger *zap.Logger
+	db        *gorm.DB
+	logger    *zap.Logger
+	jobEvents *events.Bus[OptimizationJob]
+}
+
+func NewOptimizationJobsRepo(db *AgentDatabase, logger *zap.Logger, jobEvents *events.Bus[OptimizationJob]) *OptimizationJobsRepoImpl {
+	return &OptimizationJobsRepoImpl{db: db.db, logger: logger, jobEvents: jobEvents}
 }
 
-func NewOptimizationJobsRepo(db *AgentDatabase, logger *zap.Logger) *OptimizationJobsRepoImpl {
-	return &OptimizationJobsRepoImpl{db: db.db, logger: logger}
+// CreateOptimizationJob queues the job, its status is always set to CREATED
+func (r *OptimizationJobsRepoImpl) CreateOptimizationJob(ctx context.Context, job *OptimizationJob) error {
+	job.Status = OptimizationJobStatusCreated
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(job).Error; err != nil {
+			return err
+		}
+		message := "created"
+		if job.TriggerSource != "" {
+			message = fmt.Sprintf("triggered by %s", job.TriggerSource)
+		}
+		return recordEvent(tx, job.ID, "", OptimizationJobStatusCreated, message)
+	})
+	if err != nil {
+		return err
+	}
+	r.jobEvents.Publish(*job)
+	return nil
 }
 
-func (r *OptimizationJobsRepoImpl) CreateOptimizationJob(ctx context.Context, command string) error {
-	job := &OptimizationJob{
-		Command: command,
-		Status:  OptimizationJobStatusCreated,
+// CreateDerivedOptimizationJob stores a job that never runs because its report is derived from its parent job,
+// its status is always set to SUCCEEDED. The report, if any, is stored with the job in one transaction.
+func (r *OptimizationJobsRepoImpl) CreateDerivedOptimizationJob(ctx context.Context, job *OptimizationJob, report *Report) error {
+	job.Status = OptimizationJobStatusSucceeded
+	job.TriggerSource = OptimizationJobTriggerSourceDerived
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(job).Error; err != nil {
+			return err
+		}
+		message := "report derived from its parent job"
+		if job.ParentJobID != nil {
+			message = fmt.Sprintf("report derived from job %d", *job.ParentJobID)
+		}
+		if err := recordEvent(tx, job.ID, "", OptimizationJobStatusSucceeded, message); err != nil {
+			return err
+		}
+		if report == nil {
+			return nil
+		}
+		report.OptimizationJobID = job.ID
+		return tx.Create(report).Error
+	})
+	if err != nil {
+		return err
 	}
-	return r.db.WithContext(ctx).Create(job).Error
+	r.jobEvents.Publish(*job)
+	return nil
 }
 
-func (r *OptimizationJobsRepoImpl) SetOptimizationJobStatus(ctx context.Context, id uint, status OptimizationJobStatus, errorMessage string) error {
-	return r.db.WithContext(ctx).Model(&OptimizationJob{}).Where("id = ?", id).Updates(map[string]any{
-		"status":        status,
-		"error_message": errorMessage,
-	}).Error
+// SetOptimizationJobStatus sets the status of a job owner is running and reports whether it did. A job that was timed
+// out or taken over by another agent in the meantime is left alone.
+func (r *OptimizationJobsRepoImpl) SetOptimizationJobStatus(ctx context.Context, id uint, owner string, status OptimizationJobStatus, errorMessage string) (bool, error) {
+	updated := false
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&OptimizationJob{}).Where("id = ? AND status = ? AND owner = ?", id, OptimizationJobStatusInProgress, owner).Updates(map[string]any{
+			"status":        status,
+			"error_message": errorMessage,
+		})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		updated = true
+		return recordEvent(tx, id, OptimizationJobStatusInProgress, status, errorMessage)
+	})
+	if err != nil || !updated {
+		return false, err
+	}
+	r.publishJob(ctx, id)
+	return true, nil
+}
+
+// SucceedOptimizationJob stores the report of a job owner is running and sets the job to SUCCEEDED in one transaction,
+// so a succeeded job always has its report
+func (r *OptimizationJobsRepoImpl) SucceedOptimizationJob(ctx context.Context, id uint, owner string, report *Report) error {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&OptimizationJob{}).Where("id = ? AND status = ? AND owner = ?", id, OptimizationJobStatusInProgress, owner).Updates(map[string]any{
+			"status":        OptimizationJobStatusSucceeded,
+			"error_message": "",
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("optimization job %d is not in progress for %s anymore", id, owner)
+		}
+
+		if err := recordEvent(tx, id, OptimizationJobStatusInProgress, OptimizationJobStatusSucceeded, "report stored"); err != nil {
+			return err
+		}
+		report.OptimizationJobID = id
+		return tx.Create(report).Error
+	})
+	if err != nil {
+		return err
+	}
+	r.publishJob(ctx, id)
+	return nil
 }
 
 func (r *OptimizationJobsRepoImpl) GetOptimizationJob(ctx context.Context, id uint) (*OptimizationJob, error) {
@@ -65,29 +244,147 @@ func (r *OptimizationJobsRepoImpl) GetOptimizationJob(ctx context.Context, id ui
 	return job, err
 }
 
-func (r *OptimizationJobsRepoImpl) GetCreatedOptimizationJobAndSetInProgress(ctx context.Context) (*OptimizationJob, error) {
-	job := &OptimizationJob{}
-	// Lock for update in transaction random order
-	tx := r.db.WithContext(ctx).Begin()
-	defer tx.Rollback()
-	err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).Where("status = ?", OptimizationJobStatusCreated).Order("RANDOM()").First(job).Error
-	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-		r.logger.Error("failed to get created optimization job", zap.Error(err))
-		return nil, err
-	} else if errors.Is(err, gorm.ErrRecordNotFound) {
-		return nil, nil
+// GetCreatedOptimizationJobAndSetInProgress claims the next queued job for owner, highest priority first. On PostgreSQL
+// the job is locked with FOR UPDATE SKIP LOCKED so agents sharing the queue do not wait on each other, SQLite has no
+// row locks and the claim is a compare-and-set on the status of the job instead.
+func (r *OptimizationJobsRepoImpl) GetCreatedOptimizationJobAndSetInProgress(ctx context.Context, owner string) (*OptimizationJob, error) {
+	var job *OptimizationJob
+	var err error
+	if r.db.Dialector.Name() == config.DatabaseDialectPostgres {
+		job, err = r.lockAndClaimOptimizationJob(ctx, owner)
+	} else {
+		job, err = r.compareAndClaimOptimizationJob(ctx, owner)
 	}
-	err = tx.Model(job).Update("status", OptimizationJobStatusInProgress).Where("id = ?", job.ID).Error
 	if err != nil {
-		r.logger.Error("failed to set optimization job status to in progress", zap.Error(err))
+		r.logger.Error("failed to claim created optimization job", zap.Error(err))
 		return nil, err
 	}
-	err = tx.Commit().Error
-	if err != nil {
-		r.logger.Error("failed to commit transaction", zap.Error(err))
-		return nil, err
+	if job != nil {
+		r.jobEvents.Publish(*job)
 	}
-	return job, err
+	return job, nil
+}
+
+func (r *OptimizationJobsRepoImpl) lockAndClaimOptimizationJob(ctx context.Context, owner string) (*OptimizationJob, error) {
+	var claimed *OptimizationJob
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// commands another agent is claiming a job of right now, their jobs are passed over for the next candidates
+		var skipped []string
+		for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+			candidates := claimableOptimizationJobs(tx)
+			if len(skipped) > 0 {
+				candidates = candidates.Where("command NOT IN ?", skipped)
+			}
+			job := &OptimizationJob{}
+			err := candidates.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).First(job).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			// the row lock does not cover the other jobs of the command, so claims of the same command are serialized
+			// by a lock on the command that is released when the claim commits
+			var locked bool
+			err = tx.Raw("SELECT pg_try_advisory_xact_lock(hashtext(?))", "optimization-job-command:"+job.Command).Scan(&locked).Error
+			if err != nil {
+				return err
+			}
+			if locked {
+				ok, err := claimOptimizationJob(tx, job, owner)
+				if err != nil {
+					return err
+				}
+				if ok {
+					claimed = job
+					return nil
+				}
+			}
+			skipped = append(skipped, job.Command)
+		}
+		return nil
+	})
+	return claimed, err
+}
+
+func (r *OptimizationJobsRepoImpl) compareAndClaimOptimizationJob(ctx context.Context, owner string) (*OptimizationJob, error) {
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		job := &OptimizationJob{}
+		err := claimableOptimizationJobs(r.db.WithContext(ctx)).First(job).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var ok bool
+		err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			ok, err = claimOptimizationJob(tx, job, owner)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return job, nil
+		}
+		// another agent claimed the job, or another job of the command, in the meantime
+	}
+	return nil, nil
+}
+
+// claimableOptimizationJobs selects the queued jobs that may start now in the order they are claimed
+func claimableOptimizationJobs(tx *gorm.DB) *gorm.DB {
+	return tx.Where("status = ? AND command NOT IN (?)", OptimizationJobStatusCreated, inProgressCommands(tx)).
+		Where("next_attempt_at IS NULL OR next_attempt_at <= ?", time.Now()).
+		Order("priority desc").Order("id asc")
+}
+
+// inProgressCommands selects the commands with a job in progress, a command never has more than one
+func inProgressCommands(tx *gorm.DB) *gorm.DB {
+	return tx.Session(&gorm.Session{NewDB: true}).Model(&OptimizationJob{}).Select("command").
+		Where("status = ?", OptimizationJobStatusInProgress)
+}
+
+// claimOptimizationJob sets the job in progress for owner unless it or another job of its command was claimed since
+// it was read, and reports whether it did
+func claimOptimizationJob(tx *gorm.DB, job *OptimizationJob, owner string) (bool, error) {
+	now := time.Now()
+	result := tx.Model(&OptimizationJob{}).
+		Where("id = ? AND status = ? AND command NOT IN (?)", job.ID, OptimizationJobStatusCreated, inProgressCommands(tx)).
+		Updates(map[string]any{
+			"status":       OptimizationJobStatusInProgress,
+			"attempt":      gorm.Expr("attempt + 1"),
+			"owner":        owner,
+			"claimed_at":   now,
+			"heartbeat_at": now,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+
+	job.Status = OptimizationJobStatusInProgress
+	job.Attempt++
+	job.Owner = owner
+	job.ClaimedAt = &now
+	job.HeartbeatAt = &now
+	err := recordEvent(tx, job.ID, OptimizationJobStatusCreated, OptimizationJobStatusInProgress, fmt.Sprintf("claimed by %s, attempt %d", owner, job.Attempt))
+	return err == nil, err
+}
+
+// RenewOptimizationJobLease moves the heartbeat of a running job forward, it reports false once owner does not hold the job anymore
+func (r *OptimizationJobsRepoImpl) RenewOptimizationJobLease(ctx context.Context, id uint, owner string) (bool, error) {
+	// the heartbeat is not a change of the job, so updated_at is left alone
+	tx := r.db.WithContext(ctx).Model(&OptimizationJob{}).
+		Where("id = ? AND status = ? AND owner = ?", id, OptimizationJobStatusInProgress, owner).
+		UpdateColumn("heartbeat_at", time.Now())
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return tx.RowsAffected > 0, nil
 }
 
 func (r *OptimizationJobsRepoImpl) GetLatestOptimizationJobByCommand(ctx context.Context, command string) (*OptimizationJob, error) {
@@ -99,9 +396,281 @@ func (r *OptimizationJobsRepoImpl) GetLatestOptimizationJobByCommand(ctx context
 	return job, err
 }
 
-func (r *OptimizationJobsRepoImpl) TimeoutOutdatedOptimizationJobs(ctx context.Context, timeout time.Duration) error {
-	return r.db.WithContext(ctx).Model(&OptimizationJob{}).Where("status IN ? AND created_at < ?", []string{
-		string(OptimizationJobStatusCreated),
-		string(OptimizationJobStatusInProgress),
-	}, time.Now().Add(-timeout)).Update("status", OptimizationJobStatusTimeout).Error
+// RetryOptimizationJob puts a job owner is running back in the queue and reports whether it did, it is not claimed
+// again before nextAttemptAt. A job that was cancelled, timed out or claimed again in the meantime is left alone.
+func (r *OptimizationJobsRepoImpl) RetryOptimizationJob(ctx context.Context, id uint, owner string, nextAttemptAt time.Time, errorMessage string) (bool, error) {
+	retried := false
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&OptimizationJob{}).Where("id = ? AND status = ? AND owner = ?", id, OptimizationJobStatusInProgress, owner).Updates(map[string]any{
+			"status":          OptimizationJobStatusCreated,
+			"error_message":   errorMessage,
+			"next_attempt_at": nextAttemptAt,
+			"owner":           "",
+			"claimed_at":      nil,
+			"heartbeat_at":    nil,
+		})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		retried = true
+		return recordEvent(tx, id, OptimizationJobStatusInProgress, OptimizationJobStatusCreated,
+			fmt.Sprintf("retrying at %s: %s", nextAttemptAt.UTC().Format(time.RFC3339), errorMessage))
+	})
+	if err != nil || !retried {
+		return false, err
+	}
+	r.publishJob(ctx, id)
+	return true, nil
+}
+
+// TimeoutOutdatedOptimizationJobs times out queued jobs that could have been claimed for longer than queueTimeout,
+// and running jobs whose lease has not been renewed for leaseTimeout
+func (r *OptimizationJobsRepoImpl) TimeoutOutdatedOptimizationJobs(ctx context.Context, queueTimeout, leaseTimeout time.Duration) error {
+	now := time.Now()
+	// a retried job only waits in the queue since its backoff passed
+	err := r.timeoutOptimizationJobs(ctx, OptimizationJobStatusCreated, "COALESCE(next_attempt_at, created_at) < ?", now.Add(-queueTimeout),
+		"optimization job waited too long in the queue")
+	if err != nil {
+		return err
+	}
+	return r.timeoutOptimizationJobs(ctx, OptimizationJobStatusInProgress, "COALESCE(heartbeat_at, claimed_at, created_at) < ?", now.Add(-leaseTimeout),
+		"optimization job lease expired, the agent running it stopped responding")
+}
+
+func (r *OptimizationJobsRepoImpl) timeoutOptimizationJobs(ctx context.Context, status OptimizationJobStatus, query string, before time.Time, errorMessage string) error {
+	var jobs []OptimizationJob
+	err := r.db.WithContext(ctx).Where("status = ?", status).Where(query, before).Find(&jobs).Error
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	var ids []uint
+	err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, job := range jobs {
+			// the condition is checked again so a job renewed or claimed in the meantime is left alone
+			result := tx.Model(&OptimizationJob{}).Where("id = ? AND status = ?", job.ID, status).Where(query, before).Updates(map[string]any{
+				"status":        OptimizationJobStatusTimeout,
+				"error_message": errorMessage,
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				continue
+			}
+			if err := recordEvent(tx, job.ID, status, OptimizationJobStatusTimeout, errorMessage); err != nil {
+				return err
+			}
+			ids = append(ids, job.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		r.publishJob(ctx, id)
+	}
+	return nil
+}
+
+// CancelCreatedOptimizationJob cancels the job only if it is still waiting in the queue and reports whether it did
+func (r *OptimizationJobsRepoImpl) CancelCreatedOptimizationJob(ctx context.Context, id uint) (bool, error) {
+	errorMessage := "optimization job was cancelled before it started"
+	cancelled := false
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&OptimizationJob{}).Where("id = ? AND status = ?", id, OptimizationJobStatusCreated).Updates(map[string]any{
+			"status":        OptimizationJobStatusCancelled,
+			"error_message": errorMessage,
+		})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		cancelled = true
+		return recordEvent(tx, id, OptimizationJobStatusCreated, OptimizationJobStatusCancelled, errorMessage)
+	})
+	if err != nil || !cancelled {
+		return false, err
+	}
+	r.publishJob(ctx, id)
+	return true, nil
+}
+
+func (r *OptimizationJobsRepoImpl) ListOptimizationJobs(ctx context.Context, filter OptimizationJobsFilter) ([]OptimizationJob, error) {
+	tx := r.db.WithContext(ctx).Model(&OptimizationJob{})
+	if len(filter.Commands) > 0 {
+		tx = tx.Where("command IN ?", filter.Commands)
+	}
+	if len(filter.Statuses) > 0 {
+		tx = tx.Where("status IN ?", filter.Statuses)
+	}
+	if filter.CreatedAfter != nil {
+		tx = tx.Where("created_at >= ?", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		tx = tx.Where("created_at < ?", *filter.CreatedBefore)
+	}
+	if filter.Ascending {
+		if filter.AfterID != 0 {
+			tx = tx.Where("id > ?", filter.AfterID)
+		}
+		tx = tx.Order("id asc")
+	} else {
+		if filter.AfterID != 0 {
+			tx = tx.Where("id < ?", filter.AfterID)
+		}
+		tx = tx.Order("id desc")
+	}
+	if filter.Limit > 0 {
+		tx = tx.Limit(filter.Limit)
+	}
+
+	var jobs []OptimizationJob
+	err := tx.Find(&jobs).Error
+	return jobs, err
+}
+
+// ListOrphanedOptimizationJobs lists the jobs in progress that owner claimed before, or whose lease expired
+func (r *OptimizationJobsRepoImpl) ListOrphanedOptimizationJobs(ctx context.Context, owner string, leaseTimeout time.Duration) ([]OptimizationJob, error) {
+	var jobs []OptimizationJob
+	err := r.db.WithContext(ctx).Where("status = ?", OptimizationJobStatusInProgress).
+		Where("owner = ? OR COALESCE(heartbeat_at, claimed_at, created_at) < ?", owner, time.Now().Add(-leaseTimeout)).
+		Order("id asc").Find(&jobs).Error
+	return jobs, err
+}
+
+// ListExpiredOptimizationJobs lists the finished jobs beyond the latest keepPerCommand of their command and the ones
+// created before createdBefore, zero values disable either policy. The job of the latest report of a command is never listed,
+// neither is the parent of a derived job that is kept.
+func (r *OptimizationJobsRepoImpl) ListExpiredOptimizationJobs(ctx context.Context, keepPerCommand int, createdBefore time.Time) ([]OptimizationJob, error) {
+	latestReports := r.db.Model(&Report{}).Select("MAX(optimization_job_id)").Where("custom_parameters = ?", false).Group("command")
+	expiredJobs := func() *gorm.DB {
+		return r.db.WithContext(ctx).Where("status IN ? AND id NOT IN (?)", finishedOptimizationJobStatuses, latestReports)
+	}
+
+	expired := make(map[uint]OptimizationJob)
+	if !createdBefore.IsZero() {
+		var jobs []OptimizationJob
+		if err := expiredJobs().Where("created_at < ?", createdBefore).Find(&jobs).Error; err != nil {
+			return nil, err
+		}
+		for _, job := range jobs {
+			expired[job.ID] = job
+		}
+	}
+	if keepPerCommand > 0 {
+		var commands []string
+		if err := r.db.WithContext(ctx).Model(&OptimizationJob{}).Distinct().Pluck("command", &commands).Error; err != nil {
+			return nil, err
+		}
+		for _, command := range commands {
+			var jobs []OptimizationJob
+			err := expiredJobs().Where("command = ?", command).Order("id desc").Offset(keepPerCommand).Find(&jobs).Error
+			if err != nil {
+				return nil, err
+			}
+			for _, job := range jobs {
+				expired[job.ID] = job
+			}
+		}
+	}
+
+	if err := r.keepParentsOfKeptJobs(ctx, expired); err != nil {
+		return nil, err
+	}
+
+	jobs := make([]OptimizationJob, 0, len(expired))
+	for _, job := range expired {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs, nil
+}
+
+// keepParentsOfKeptJobs drops the jobs from expired that derived jobs outside of expired still point to, a parent
+// expires along with the last of its derived jobs
+func (r *OptimizationJobsRepoImpl) keepParentsOfKeptJobs(ctx context.Context, expired map[uint]OptimizationJob) error {
+	if len(expired) == 0 {
+		return nil
+	}
+	ids := make([]uint, 0, len(expired))
+	for id := range expired {
+		ids = append(ids, id)
+	}
+
+	var derived []OptimizationJob
+	err := r.db.WithContext(ctx).Select("id", "parent_job_id").Where("parent_job_id IN ?", ids).Find(&derived).Error
+	if err != nil {
+		return err
+	}
+	for _, job := range derived {
+		if _, ok := expired[job.ID]; !ok {
+			delete(expired, *job.ParentJobID)
+		}
+	}
+	return nil
+}
+
+// DeleteOptimizationJobs deletes the jobs and their reports for good. Their events are replaced by a single event
+// recording the deletion, which DeleteOptimizationJobEvents removes later on. Derived jobs that are kept lose the
+// reference to their deleted parent job.
+func (r *OptimizationJobsRepoImpl) DeleteOptimizationJobs(ctx context.Context, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var jobs []OptimizationJob
+		if err := tx.Select("id", "status").Where("id IN ?", ids).Find(&jobs).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("optimization_job_id IN ?", ids).Delete(&Report{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("optimization_job_id IN ?", ids).Delete(&OptimizationJobEvent{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("id IN ?", ids).Delete(&OptimizationJob{}).Error; err != nil {
+			return err
+		}
+		err := tx.Unscoped().Model(&OptimizationJob{}).Where("parent_job_id IN ?", ids).UpdateColumn("parent_job_id", nil).Error
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			if err := recordEvent(tx, job.ID, job.Status, "", "deleted by the retention policy"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListOptimizationJobEvents lists the events of the job in the order they happened
+func (r *OptimizationJobsRepoImpl) ListOptimizationJobEvents(ctx context.Context, id uint) ([]OptimizationJobEvent, error) {
+	var events []OptimizationJobEvent
+	err := r.db.WithContext(ctx).Where("optimization_job_id = ?", id).Order("id asc").Find(&events).Error
+	return events, err
+}
+
+// DeleteOptimizationJobEvents deletes the events left from deleted jobs that were recorded before createdBefore
+func (r *OptimizationJobsRepoImpl) DeleteOptimizationJobEvents(ctx context.Context, createdBefore time.Time) error {
+	jobIDs := r.db.Unscoped().Model(&OptimizationJob{}).Select("id")
+	return r.db.WithContext(ctx).Where("created_at < ? AND optimization_job_id NOT IN (?)", createdBefore, jobIDs).
+		Delete(&OptimizationJobEvent{}).Error
+}
+
+// publishJob reloads the job so subscribers always see the stored state
+func (r *OptimizationJobsRepoImpl) publishJob(ctx context.Context, id uint) {
+	job, err := r.GetOptimizationJob(ctx, id)
+	if err != nil {
+		r.logger.Error("failed to load optimization job for publishing", zap.Uint("id", id), zap.Error(err))
+		return
+	}
+	r.jobEvents.Publish(*job)
 }
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/kaytu-io/kaytu-agent/config"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Report is the report a job produced. Content is compressed with Compression, Size and SHA256 describe the
+// uncompressed report so it can be checked when it is read back.
+type Report struct {
+	ID                uint             `json:"id" gorm:"primarykey"`
+	OptimizationJobID uint             `json:"optimizationJobId" gorm:"uniqueIndex"`
+	OptimizationJob   *OptimizationJob `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	Command           string           `json:"command" gorm:"index"`
+	// CustomParameters is set for reports of jobs that overrode the agent configuration, they never become the latest report
+	CustomParameters bool `json:"customParameters"`
+
+	Compression    string    `json:"compression"`
+	Content        []byte    `json:"-"`
+	Size           int64     `json:"size"`
+	CompressedSize int64     `json:"compressedSize"`
+	SHA256         string    `json:"sha256"`
+	GeneratedAt    time.Time `json:"generatedAt"`
+}
+
+type ReportsRepo interface {
+	GetReport(ctx context.Context, command string, jobID uint) (*Report, error)
+	ListReports(ctx context.Context, command string) ([]Report, error)
+	DeleteReports(ctx context.Context, ids []uint) error
+	ImportReport(ctx context.Context, report *Report) (bool, error)
+}
+
+type ReportsRepoImpl struct {
+	db     *gorm.DB
+	logger *zap.Logger
+}
+
+func NewReportsRepo(db *AgentDatabase, logger *zap.Logger) *ReportsRepoImpl {
+	return &ReportsRepoImpl{db: db.db, logger: logger}
+}
+
+// GetReport returns the report of the job, jobID 0 returns the latest report of the command. It returns nil if there is none.
+func (r *ReportsRepoImpl) GetReport(ctx context.Context, command string, jobID uint) (*Report, error) {
+	tx := r.db.WithContext(ctx).Where("command = ?", command)
+	if jobID == 0 {
+		tx = tx.Where("custom_parameters = ?", false).Order("optimization_job_id desc")
+	} else {
+		tx = tx.Where("optimization_job_id = ?", jobID)
+	}
+
+	report := &Report{}
+	err := tx.First(report).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return report, err
+}
+
+// ListReports lists the reports of the command newest first, without their content
+func (r *ReportsRepoImpl) ListReports(ctx context.Context, command string) ([]Report, error) {
+	var reports []Report
+	err := r.db.WithContext(ctx).Omit("content").Where("command = ?", command).
+		Order("optimization_job_id desc").Find(&reports).Error
+	return reports, err
+}
+
+func (r *ReportsRepoImpl) DeleteReports(ctx context.Context, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return r.db.WithContext(ctx).Where("id IN ?", ids).Delete(&Report{}).Error
+}
+
+// ImportReport stores a report an agent kept on the filesystem before it stored reports in the database, and tells
+// whether it did. A report with a job id is attached to that job, unless the job is gone, belongs to another command or
+// already has a report. A report without one is recorded under a new SUCCEEDED job, unless the command already has a
+// report that is not custom.
+func (r *ReportsRepoImpl) ImportReport(ctx context.Context, report *Report) (bool, error) {
+	imported := false
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if tx.Dialector.Name() == config.DatabaseDialectPostgres {
+			// replicas sharing the database import the reports of a command one at a time
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "report-import:"+report.Command).Error; err != nil {
+				return err
+			}
+		}
+
+		if report.OptimizationJobID != 0 {
+			var jobs, reports int64
+			err := tx.Model(&OptimizationJob{}).Where("id = ? AND command = ?", report.OptimizationJobID, report.Command).Count(&jobs).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&Report{}).Where("optimization_job_id = ?", report.OptimizationJobID).Count(&reports).Error
+			if err != nil || jobs == 0 || reports > 0 {
+				return err
+			}
+		} else {
+			var reports int64
+			err := tx.Model(&Report{}).Where("command = ? AND custom_parameters = ?", report.Command, false).Count(&reports).Error
+			if err != nil || reports > 0 {
+				return err
+			}
+			job := &OptimizationJob{
+				Command:       report.Command,
+				Status:        OptimizationJobStatusSucceeded,
+				TriggerSource: OptimizationJobTriggerSourceImport,
+				Attempt:       1,
+				MaxAttempts:   1,
+			}
+			if err := tx.Create(job).Error; err != nil {
+				return err
+			}
+			if err := recordEvent(tx, job.ID, "", OptimizationJobStatusSucceeded, "report imported from the filesystem"); err != nil {
+				return err
+			}
+			report.OptimizationJobID = job.ID
+		}
+
+		imported = true
+		return tx.Create(report).Error
+	})
+	return imported && err == nil, err
+}
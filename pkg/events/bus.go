@@ -0,0 +1,51 @@
+package events
+
+import "sync"
+
+// Bus is an in-process publish/subscribe hub. Publish never blocks, a subscriber
+// that does not drain its channel fast enough misses events instead of stalling the publisher.
+type Bus[T any] struct {
+	mu          sync.RWMutex
+	nextID      uint64
+	subscribers map[uint64]chan T
+}
+
+func NewBus[T any]() *Bus[T] {
+	return &Bus[T]{
+		subscribers: make(map[uint64]chan T),
+	}
+}
+
+// Subscribe registers a new subscriber with the given channel buffer size.
+// The returned func must be called to unsubscribe, it closes the channel.
+func (b *Bus[T]) Subscribe(buffer int) (<-chan T, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	ch := make(chan T, buffer)
+	b.subscribers[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subscribers, id)
+			close(ch)
+		})
+	}
+}
+
+func (b *Bus[T]) Publish(event T) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidPreferences is returned by Optimize when the preference overrides do not apply to the preferences file,
+// retrying does not help
+var ErrInvalidPreferences = errors.New("invalid preference overrides")
+
+// writePreferences copies the preferences file at basePath into workingDir with the values of the overridden keys replaced
+func (c *KaytuCmd) writePreferences(workingDir, basePath string, overrides map[string]string) (string, error) {
+	content, err := os.ReadFile(basePath)
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to read %s: %w", ErrInvalidPreferences, basePath, err)
+	}
+
+	var preferences []map[string]any
+	if err := yaml.Unmarshal(content, &preferences); err != nil {
+		return "", fmt.Errorf("%w: failed to parse %s: %w", ErrInvalidPreferences, basePath, err)
+	}
+
+	applied := make(map[string]bool)
+	for _, preference := range preferences {
+		key, _ := preference["key"].(string)
+		if value, ok := overrides[key]; ok {
+			preference["value"] = value
+			applied[key] = true
+		}
+	}
+	for key := range overrides {
+		if !applied[key] {
+			return "", fmt.Errorf("%w: unknown preference %s", ErrInvalidPreferences, key)
+		}
+	}
+
+	content, err = yaml.Marshal(preferences)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(workingDir, "preferences.yaml")
+	if err := os.WriteFile(path, content, os.ModePerm); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// labelSelector formats labels as a kubernetes equality based label selector
+func labelSelector(labels map[string]string) string {
+	selectors := make([]string, 0, len(labels))
+	for key, value := range labels {
+		selectors = append(selectors, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(selectors)
+	return strings.Join(selectors, ",")
+}
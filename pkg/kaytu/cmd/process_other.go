@@ -0,0 +1,8 @@
+//go:build !unix
+
+package cmd
+
+import "os/exec"
+
+// killProcessGroupOnCancel leaves cmd as it is, only kaytu itself is killed when its context is cancelled
+func killProcessGroupOnCancel(*exec.Cmd) {}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package cmd
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killProcessGroupOnCancel starts cmd in a process group of its own and makes cancelling its context kill the whole
+// group, so the plugin processes kaytu started stop querying prometheus along with it
+func killProcessGroupOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	githubAPI "github.com/google/go-github/v62/github"
 	"github.com/kaytu-io/kaytu-agent/config"
@@ -15,11 +16,20 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 )
 
+// ErrLoginFailed is returned by Initialize when kaytu rejects the configured api key, retrying does not help
+var ErrLoginFailed = errors.New("failed to login to kaytu")
+
 type KaytuCmd struct {
 	logger *zap.Logger
 	cfg    *config.Config
+
+	// initializeRunMutex serializes Initialize calls of concurrent workers, they share the kaytu installation and login
+	initializeRunMutex sync.Mutex
+	initializeMutex    sync.RWMutex
+	initializeErr      error
 }
 
 func New(logger *zap.Logger, cfg *config.Config) *KaytuCmd {
@@ -29,16 +39,27 @@ func New(logger *zap.Logger, cfg *config.Config) *KaytuCmd {
 	}
 }
 
-func (c *KaytuCmd) Optimize(ctx context.Context, command string) error {
-	c.logger.Info("running optimization", zap.String("command", command))
+// OptimizeOptions override the agent configuration for a single optimization, the zero value keeps it as is
+type OptimizeOptions struct {
+	ObservabilityDays int
+	// Preferences override the values of the preferences file by preference key
+	Preferences map[string]string
+	Namespaces  []string
+	Labels      map[string]string
+}
+
+// Optimize runs the kaytu optimization of the command inside workingDir, where the partial report is written,
+// and moves the finished report to outputPath.
+func (c *KaytuCmd) Optimize(ctx context.Context, command string, workingDir string, outputPath string, options OptimizeOptions) error {
+	c.logger.Info("running optimization", zap.String("command", command), zap.String("workingDir", workingDir))
 
 	if err := ctx.Err(); err != nil {
 		c.logger.Error("context error", zap.Error(err))
 		return err
 	}
 
-	kaytuWorkingDir := c.cfg.WorkingDirectory
-	kaytuOutputDir := c.cfg.GetOutputDirectory()
+	kaytuWorkingDir := workingDir
+	kaytuOutputDir := filepath.Dir(outputPath)
 	err := os.MkdirAll(kaytuWorkingDir, os.ModePerm)
 	if err != nil {
 		c.logger.Error("failed to create kaytu working directory", zap.Error(err))
@@ -50,10 +71,30 @@ func (c *KaytuCmd) Optimize(ctx context.Context, command string) error {
 		return err
 	}
 
-	args := []string{"optimize", command, "--agent-mode", "--output", "json", "--agent-disabled", "true", "--preferences", filepath.Join(config.ConfigDirectory, "preferences.yaml")}
-	if c.cfg.KaytuConfig.ObservabilityDays > 0 {
-		args = append(args, "--observabilityDays", fmt.Sprintf("%d", c.cfg.KaytuConfig.ObservabilityDays))
+	preferencesPath := filepath.Join(config.ConfigDirectory, "preferences.yaml")
+	if len(options.Preferences) > 0 {
+		preferencesPath, err = c.writePreferences(kaytuWorkingDir, preferencesPath, options.Preferences)
+		if err != nil {
+			c.logger.Error("failed to write preferences", zap.Error(err))
+			return err
+		}
+	}
+
+	args := []string{"optimize", command, "--agent-mode", "--output", "json", "--agent-disabled", "true", "--preferences", preferencesPath}
+	observabilityDays := c.cfg.KaytuConfig.ObservabilityDays
+	if options.ObservabilityDays > 0 {
+		observabilityDays = options.ObservabilityDays
+	}
+	if observabilityDays > 0 {
+		args = append(args, "--observabilityDays", fmt.Sprintf("%d", observabilityDays))
 	}
+	if len(options.Namespaces) > 0 {
+		args = append(args, "--namespace", strings.Join(options.Namespaces, ","))
+	}
+	if len(options.Labels) > 0 {
+		args = append(args, "--selector", labelSelector(options.Labels))
+	}
+	args = append(args, c.cfg.Commands[command].ExtraArgs...)
 	if c.cfg.KaytuConfig.Prometheus.Address != "" {
 		args = append(args, "--prom-address", c.cfg.KaytuConfig.Prometheus.Address)
 	}
@@ -76,46 +117,58 @@ func (c *KaytuCmd) Optimize(ctx context.Context, command string) error {
 		args = append(args, "--prom-scopes", c.cfg.KaytuConfig.Prometheus.Scopes)
 	}
 	cmd := exec.CommandContext(ctx, "kaytu", args...)
+	cmd.Dir = kaytuWorkingDir
 	cmd.Stderr = os.Stderr
+	killProcessGroupOnCancel(cmd)
 
-	outRC, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
-
-	err = os.MkdirAll(kaytuOutputDir, os.ModePerm)
-	if err != nil {
-		c.logger.Error("failed to create output directory", zap.Error(err))
-		return err
-	}
-	dirtyPath := filepath.Join(c.cfg.GetOutputDirectory(), fmt.Sprintf("out-%s-dirty.json", command))
-	cleanPath := filepath.Join(c.cfg.GetOutputDirectory(), fmt.Sprintf("out-%s.json", command))
+	dirtyPath := filepath.Join(kaytuWorkingDir, fmt.Sprintf("out-%s-dirty.json", command))
+	cleanPath := outputPath
 	os.Remove(dirtyPath)
 	f, err := os.OpenFile(dirtyPath, os.O_CREATE|os.O_RDWR, os.ModePerm)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	go func() {
-		io.Copy(f, outRC)
+	// a failed, timed out or cancelled run leaves a partial report behind
+	defer func() {
+		if err != nil {
+			os.Remove(dirtyPath)
+		}
 	}()
+	cmd.Stdout = f
 
-	err = cmd.Start()
-	if err != nil {
-		return err
-	}
-
-	err = cmd.Wait()
+	err = cmd.Run()
 	if err != nil {
 		return err
 	}
 
 	c.logger.Info("optimization finished", zap.String("command", command))
-	return os.Rename(dirtyPath, cleanPath)
+	err = os.Rename(dirtyPath, cleanPath)
+	return err
 }
 
-// Initialize checks if kaytu is installed and installs the latest version if it is outdated, then logs in to kaytu and installs the kubernetes plugin
+// Initialize checks if kaytu is installed and installs the latest version if it is outdated, then logs in to kaytu and installs the plugins of the enabled commands
 func (c *KaytuCmd) Initialize(ctx context.Context) error {
+	c.initializeRunMutex.Lock()
+	defer c.initializeRunMutex.Unlock()
+
+	err := c.initialize(ctx)
+
+	c.initializeMutex.Lock()
+	c.initializeErr = err
+	c.initializeMutex.Unlock()
+
+	return err
+}
+
+// LastInitializeError returns the error of the last Initialize call, nil if it succeeded or was never called
+func (c *KaytuCmd) LastInitializeError() error {
+	c.initializeMutex.RLock()
+	defer c.initializeMutex.RUnlock()
+	return c.initializeErr
+}
+
+func (c *KaytuCmd) initialize(ctx context.Context) error {
 	if err := ctx.Err(); err != nil {
 		c.logger.Error("context error", zap.Error(err))
 		return err
@@ -188,24 +241,26 @@ func (c *KaytuCmd) Initialize(ctx context.Context) error {
 			return err
 		}
 
-		return c.Initialize(ctx)
+		return c.initialize(ctx)
 	}
 
-	cmd = exec.CommandContext(ctx, "kaytu", "plugin", "install", "kubernetes")
-	c.logger.Info("installing kubernetes plugin")
-	out, err = cmd.CombinedOutput()
-	if err != nil {
-		c.logger.Error("failed to install kubernetes plugin", zap.Error(err), zap.String("output", string(out)))
-		return err
+	for _, plugin := range c.cfg.GetPlugins() {
+		cmd = exec.CommandContext(ctx, "kaytu", "plugin", "install", plugin)
+		c.logger.Info("installing plugin", zap.String("plugin", plugin))
+		out, err = cmd.CombinedOutput()
+		if err != nil {
+			c.logger.Error("failed to install plugin", zap.String("plugin", plugin), zap.Error(err), zap.String("output", string(out)))
+			return err
+		}
+		c.logger.Info("plugin is installed", zap.String("plugin", plugin), zap.String("output", string(out)))
 	}
-	c.logger.Info("kubernetes plugin is installed", zap.String("output", string(out)))
 
 	cmd = exec.CommandContext(ctx, "kaytu", "login", "--api-key", c.cfg.KaytuConfig.ApiKey)
 	c.logger.Info("logging in to kaytu")
 	out, err = cmd.CombinedOutput()
 	if err != nil {
 		c.logger.Error("failed to login", zap.Error(err), zap.String("output", string(out)))
-		return err
+		return fmt.Errorf("%w: %w", ErrLoginFailed, err)
 	}
 	c.logger.Info("logged in to kaytu", zap.String("output", string(out)))
 
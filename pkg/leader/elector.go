@@ -0,0 +1,71 @@
+package leader
+
+import (
+	"context"
+	"github.com/kaytu-io/kaytu-agent/config"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Elector campaigns for a kubernetes Lease, leases is usually the coordination client of a clientset and can be a fake one
+type Elector struct {
+	logger   *zap.Logger
+	cfg      config.LeaderElectionConfig
+	identity string
+	leases   coordinationv1client.LeasesGetter
+}
+
+func NewElector(logger *zap.Logger, cfg config.LeaderElectionConfig, identity string, leases coordinationv1client.LeasesGetter) *Elector {
+	return &Elector{
+		logger:   logger,
+		cfg:      cfg,
+		identity: identity,
+		leases:   leases,
+	}
+}
+
+// Run calls lead with a context that is done once the leadership is lost, and campaigns again after that until ctx is done
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context)) error {
+	for ctx.Err() == nil {
+		elector, err := e.newLeaderElector(lead)
+		if err != nil {
+			return err
+		}
+		elector.Run(ctx)
+	}
+	return nil
+}
+
+func (e *Elector) newLeaderElector(lead func(ctx context.Context)) (*leaderelection.LeaderElector, error) {
+	return leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      e.cfg.LeaseName,
+				Namespace: e.cfg.GetLeaseNamespace(),
+			},
+			Client:     e.leases,
+			LockConfig: resourcelock.ResourceLockConfig{Identity: e.identity},
+		},
+		LeaseDuration: e.cfg.GetLeaseDuration(),
+		RenewDeadline: e.cfg.GetRenewDeadline(),
+		RetryPeriod:   e.cfg.GetRetryPeriod(),
+		// a replica shutting down hands the lease over right away
+		ReleaseOnCancel: true,
+		Name:            e.cfg.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				e.logger.Info("started leading", zap.String("identity", e.identity))
+				lead(ctx)
+			},
+			OnStoppedLeading: func() {
+				e.logger.Info("stopped leading", zap.String("identity", e.identity))
+			},
+			OnNewLeader: func(identity string) {
+				e.logger.Info("leader elected", zap.String("leader", identity))
+			},
+		},
+	})
+}
@@ -0,0 +1,114 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kaytu-io/kaytu-agent/config"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestElector(t *testing.T) {
+	cfg := config.LeaderElectionConfig{
+		LeaseName:            "kaytu-agent",
+		LeaseNamespace:       "default",
+		LeaseDurationSeconds: 3,
+		RenewDeadlineSeconds: 2,
+		RetryPeriodSeconds:   1,
+	}
+	clientset := fake.NewSimpleClientset()
+	// failing renewals lose the lease the way an agent cut off from the api server does
+	var failRenewals atomic.Bool
+	clientset.PrependReactor("update", "leases", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if failRenewals.Load() {
+			return true, nil, errors.New("lease renewal failed")
+		}
+		return false, nil, nil
+	})
+
+	// lead starts a leader-only loop that runs until the context it is given is done
+	var running, started atomic.Int32
+	lead := func(ctx context.Context) {
+		started.Add(1)
+		running.Add(1)
+		go func() {
+			defer running.Add(-1)
+			ticker := time.NewTicker(10 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	elector := NewElector(zap.NewNop(), cfg, "agent-0", clientset.CoordinationV1())
+	go func() {
+		done <- elector.Run(ctx, lead)
+	}()
+
+	eventually(t, "the lease to be acquired", func() bool {
+		return running.Load() == 1
+	})
+	lease, err := clientset.CoordinationV1().Leases("default").Get(ctx, "kaytu-agent", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != "agent-0" {
+		t.Fatalf("got holder %v, want agent-0", lease.Spec.HolderIdentity)
+	}
+
+	failRenewals.Store(true)
+	eventually(t, "the leader-only loop to stop once the lease is lost", func() bool {
+		return running.Load() == 0
+	})
+
+	failRenewals.Store(false)
+	eventually(t, "the lease to be acquired again", func() bool {
+		return running.Load() == 1 && started.Load() == 2
+	})
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("elector did not stop")
+	}
+	eventually(t, "the leader-only loop to stop on shutdown", func() bool {
+		return running.Load() == 0
+	})
+	// the lease is released on shutdown so another replica takes over right away
+	lease, err = clientset.CoordinationV1().Leases("default").Get(context.Background(), "kaytu-agent", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != "" {
+		t.Errorf("got holder %s after shutdown, want none", *lease.Spec.HolderIdentity)
+	}
+}
+
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
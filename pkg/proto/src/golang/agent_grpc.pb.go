@@ -27,6 +27,15 @@ type AgentClient interface {
 	Ping(ctx context.Context, in *PingMessage, opts ...grpc.CallOption) (*PingMessage, error)
 	TriggerJob(ctx context.Context, in *TriggerJobRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
 	GetLatestJobs(ctx context.Context, in *GetLatestJobsRequest, opts ...grpc.CallOption) (*GetLatestJobsResponse, error)
+	CancelJob(ctx context.Context, in *CancelJobRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ListJobs(ctx context.Context, in *ListJobsRequest, opts ...grpc.CallOption) (*ListJobsResponse, error)
+	WatchJobs(ctx context.Context, in *WatchJobsRequest, opts ...grpc.CallOption) (Agent_WatchJobsClient, error)
+	ListReports(ctx context.Context, in *ListReportsRequest, opts ...grpc.CallOption) (*ListReportsResponse, error)
+	StreamReport(ctx context.Context, in *StreamReportRequest, opts ...grpc.CallOption) (Agent_StreamReportClient, error)
+	QueryRecommendations(ctx context.Context, in *QueryRecommendationsRequest, opts ...grpc.CallOption) (*QueryRecommendationsResponse, error)
+	DiffReports(ctx context.Context, in *DiffReportsRequest, opts ...grpc.CallOption) (*DiffReportsResponse, error)
+	ListCommands(ctx context.Context, in *ListCommandsRequest, opts ...grpc.CallOption) (*ListCommandsResponse, error)
+	GetJobEvents(ctx context.Context, in *GetJobEventsRequest, opts ...grpc.CallOption) (*GetJobEventsResponse, error)
 }
 
 type agentClient struct {
@@ -73,6 +82,133 @@ func (c *agentClient) GetLatestJobs(ctx context.Context, in *GetLatestJobsReques
 	return out, nil
 }
 
+func (c *agentClient) CancelJob(ctx context.Context, in *CancelJobRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/kaytu.agent.v1.Agent/CancelJob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) ListJobs(ctx context.Context, in *ListJobsRequest, opts ...grpc.CallOption) (*ListJobsResponse, error) {
+	out := new(ListJobsResponse)
+	err := c.cc.Invoke(ctx, "/kaytu.agent.v1.Agent/ListJobs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) WatchJobs(ctx context.Context, in *WatchJobsRequest, opts ...grpc.CallOption) (Agent_WatchJobsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Agent_ServiceDesc.Streams[0], "/kaytu.agent.v1.Agent/WatchJobs", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentWatchJobsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Agent_WatchJobsClient interface {
+	Recv() (*OptimizationJob, error)
+	grpc.ClientStream
+}
+
+type agentWatchJobsClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentWatchJobsClient) Recv() (*OptimizationJob, error) {
+	m := new(OptimizationJob)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentClient) ListReports(ctx context.Context, in *ListReportsRequest, opts ...grpc.CallOption) (*ListReportsResponse, error) {
+	out := new(ListReportsResponse)
+	err := c.cc.Invoke(ctx, "/kaytu.agent.v1.Agent/ListReports", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) StreamReport(ctx context.Context, in *StreamReportRequest, opts ...grpc.CallOption) (Agent_StreamReportClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Agent_ServiceDesc.Streams[1], "/kaytu.agent.v1.Agent/StreamReport", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentStreamReportClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Agent_StreamReportClient interface {
+	Recv() (*StreamReportResponse, error)
+	grpc.ClientStream
+}
+
+type agentStreamReportClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentStreamReportClient) Recv() (*StreamReportResponse, error) {
+	m := new(StreamReportResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentClient) QueryRecommendations(ctx context.Context, in *QueryRecommendationsRequest, opts ...grpc.CallOption) (*QueryRecommendationsResponse, error) {
+	out := new(QueryRecommendationsResponse)
+	err := c.cc.Invoke(ctx, "/kaytu.agent.v1.Agent/QueryRecommendations", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) DiffReports(ctx context.Context, in *DiffReportsRequest, opts ...grpc.CallOption) (*DiffReportsResponse, error) {
+	out := new(DiffReportsResponse)
+	err := c.cc.Invoke(ctx, "/kaytu.agent.v1.Agent/DiffReports", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) ListCommands(ctx context.Context, in *ListCommandsRequest, opts ...grpc.CallOption) (*ListCommandsResponse, error) {
+	out := new(ListCommandsResponse)
+	err := c.cc.Invoke(ctx, "/kaytu.agent.v1.Agent/ListCommands", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) GetJobEvents(ctx context.Context, in *GetJobEventsRequest, opts ...grpc.CallOption) (*GetJobEventsResponse, error) {
+	out := new(GetJobEventsResponse)
+	err := c.cc.Invoke(ctx, "/kaytu.agent.v1.Agent/GetJobEvents", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // AgentServer is the server API for Agent service.
 // All implementations must embed UnimplementedAgentServer
 // for forward compatibility
@@ -81,6 +217,15 @@ type AgentServer interface {
 	Ping(context.Context, *PingMessage) (*PingMessage, error)
 	TriggerJob(context.Context, *TriggerJobRequest) (*emptypb.Empty, error)
 	GetLatestJobs(context.Context, *GetLatestJobsRequest) (*GetLatestJobsResponse, error)
+	CancelJob(context.Context, *CancelJobRequest) (*emptypb.Empty, error)
+	ListJobs(context.Context, *ListJobsRequest) (*ListJobsResponse, error)
+	WatchJobs(*WatchJobsRequest, Agent_WatchJobsServer) error
+	ListReports(context.Context, *ListReportsRequest) (*ListReportsResponse, error)
+	StreamReport(*StreamReportRequest, Agent_StreamReportServer) error
+	QueryRecommendations(context.Context, *QueryRecommendationsRequest) (*QueryRecommendationsResponse, error)
+	DiffReports(context.Context, *DiffReportsRequest) (*DiffReportsResponse, error)
+	ListCommands(context.Context, *ListCommandsRequest) (*ListCommandsResponse, error)
+	GetJobEvents(context.Context, *GetJobEventsRequest) (*GetJobEventsResponse, error)
 	mustEmbedUnimplementedAgentServer()
 }
 
@@ -100,6 +245,33 @@ func (UnimplementedAgentServer) TriggerJob(context.Context, *TriggerJobRequest)
 func (UnimplementedAgentServer) GetLatestJobs(context.Context, *GetLatestJobsRequest) (*GetLatestJobsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetLatestJobs not implemented")
 }
+func (UnimplementedAgentServer) CancelJob(context.Context, *CancelJobRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelJob not implemented")
+}
+func (UnimplementedAgentServer) ListJobs(context.Context, *ListJobsRequest) (*ListJobsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListJobs not implemented")
+}
+func (UnimplementedAgentServer) WatchJobs(*WatchJobsRequest, Agent_WatchJobsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchJobs not implemented")
+}
+func (UnimplementedAgentServer) ListReports(context.Context, *ListReportsRequest) (*ListReportsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListReports not implemented")
+}
+func (UnimplementedAgentServer) StreamReport(*StreamReportRequest, Agent_StreamReportServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamReport not implemented")
+}
+func (UnimplementedAgentServer) QueryRecommendations(context.Context, *QueryRecommendationsRequest) (*QueryRecommendationsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryRecommendations not implemented")
+}
+func (UnimplementedAgentServer) DiffReports(context.Context, *DiffReportsRequest) (*DiffReportsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DiffReports not implemented")
+}
+func (UnimplementedAgentServer) ListCommands(context.Context, *ListCommandsRequest) (*ListCommandsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCommands not implemented")
+}
+func (UnimplementedAgentServer) GetJobEvents(context.Context, *GetJobEventsRequest) (*GetJobEventsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetJobEvents not implemented")
+}
 func (UnimplementedAgentServer) mustEmbedUnimplementedAgentServer() {}
 
 // UnsafeAgentServer may be embedded to opt out of forward compatibility for this service.
@@ -185,6 +357,174 @@ func _Agent_GetLatestJobs_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Agent_CancelJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).CancelJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kaytu.agent.v1.Agent/CancelJob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).CancelJob(ctx, req.(*CancelJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_ListJobs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListJobsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).ListJobs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kaytu.agent.v1.Agent/ListJobs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).ListJobs(ctx, req.(*ListJobsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_WatchJobs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchJobsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServer).WatchJobs(m, &agentWatchJobsServer{stream})
+}
+
+type Agent_WatchJobsServer interface {
+	Send(*OptimizationJob) error
+	grpc.ServerStream
+}
+
+type agentWatchJobsServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentWatchJobsServer) Send(m *OptimizationJob) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Agent_ListReports_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListReportsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).ListReports(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kaytu.agent.v1.Agent/ListReports",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).ListReports(ctx, req.(*ListReportsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_StreamReport_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamReportRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServer).StreamReport(m, &agentStreamReportServer{stream})
+}
+
+type Agent_StreamReportServer interface {
+	Send(*StreamReportResponse) error
+	grpc.ServerStream
+}
+
+type agentStreamReportServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentStreamReportServer) Send(m *StreamReportResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Agent_QueryRecommendations_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryRecommendationsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).QueryRecommendations(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kaytu.agent.v1.Agent/QueryRecommendations",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).QueryRecommendations(ctx, req.(*QueryRecommendationsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_DiffReports_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DiffReportsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).DiffReports(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kaytu.agent.v1.Agent/DiffReports",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).DiffReports(ctx, req.(*DiffReportsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_ListCommands_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCommandsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).ListCommands(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kaytu.agent.v1.Agent/ListCommands",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).ListCommands(ctx, req.(*ListCommandsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_GetJobEvents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetJobEventsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).GetJobEvents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kaytu.agent.v1.Agent/GetJobEvents",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).GetJobEvents(ctx, req.(*GetJobEventsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Agent_ServiceDesc is the grpc.ServiceDesc for Agent service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -208,7 +548,46 @@ var Agent_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetLatestJobs",
 			Handler:    _Agent_GetLatestJobs_Handler,
 		},
+		{
+			MethodName: "CancelJob",
+			Handler:    _Agent_CancelJob_Handler,
+		},
+		{
+			MethodName: "ListJobs",
+			Handler:    _Agent_ListJobs_Handler,
+		},
+		{
+			MethodName: "ListReports",
+			Handler:    _Agent_ListReports_Handler,
+		},
+		{
+			MethodName: "QueryRecommendations",
+			Handler:    _Agent_QueryRecommendations_Handler,
+		},
+		{
+			MethodName: "DiffReports",
+			Handler:    _Agent_DiffReports_Handler,
+		},
+		{
+			MethodName: "ListCommands",
+			Handler:    _Agent_ListCommands_Handler,
+		},
+		{
+			MethodName: "GetJobEvents",
+			Handler:    _Agent_GetJobEvents_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchJobs",
+			Handler:       _Agent_WatchJobs_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamReport",
+			Handler:       _Agent_StreamReport_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/proto/agent.proto",
 }
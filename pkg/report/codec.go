@@ -0,0 +1,126 @@
+package report
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/kaytu-io/kaytu-agent/config"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"github.com/klauspost/compress/zstd"
+	"hash"
+	"io"
+	"time"
+)
+
+// ErrCorrupt is returned for a stored report that does not match the size or hash recorded with it
+var ErrCorrupt = errors.New("report failed its integrity check")
+
+// encode compresses content into a report of the database, its size and hash describe the uncompressed content
+func encode(command string, customParameters bool, compression string, content []byte) (*database.Report, error) {
+	compressed, err := compress(compression, content)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	return &database.Report{
+		Command:          command,
+		CustomParameters: customParameters,
+		Compression:      compression,
+		Content:          compressed,
+		Size:             int64(len(content)),
+		CompressedSize:   int64(len(compressed)),
+		SHA256:           hex.EncodeToString(sum[:]),
+		GeneratedAt:      time.Now(),
+	}, nil
+}
+
+// decode decompresses the report and checks it against its recorded size and hash
+func decode(report *database.Report) ([]byte, error) {
+	r, err := openDecoded(report)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// openDecoded decompresses the report as it is read, so only the compressed report is held in memory. The size and
+// hash are checked once the report is read to the end, a mismatch is returned in place of io.EOF.
+func openDecoded(report *database.Report) (io.ReadCloser, error) {
+	r, err := decompressor(report.Compression, bytes.NewReader(report.Content))
+	if err != nil {
+		return nil, fmt.Errorf("%w: job %d: %w", ErrCorrupt, report.OptimizationJobID, err)
+	}
+	return &verifyingReader{r: r, report: report, hash: sha256.New()}, nil
+}
+
+type verifyingReader struct {
+	r      io.ReadCloser
+	report *database.Report
+	hash   hash.Hash
+	size   int64
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	v.size += int64(n)
+	switch {
+	case err == io.EOF:
+		if v.size != v.report.Size || hex.EncodeToString(v.hash.Sum(nil)) != v.report.SHA256 {
+			return n, fmt.Errorf("%w: job %d", ErrCorrupt, v.report.OptimizationJobID)
+		}
+	case err != nil:
+		return n, fmt.Errorf("%w: job %d: %w", ErrCorrupt, v.report.OptimizationJobID, err)
+	case v.size > v.report.Size:
+		return n, fmt.Errorf("%w: job %d", ErrCorrupt, v.report.OptimizationJobID)
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.r.Close()
+}
+
+func compress(compression string, content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch compression {
+	case config.ReportCompressionZstd:
+		w, err = zstd.NewWriter(&buf)
+	case config.ReportCompressionGzip:
+		w = gzip.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unsupported report compression %s", compression)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(content); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressor(compression string, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case config.ReportCompressionZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case config.ReportCompressionGzip:
+		return gzip.NewReader(r)
+	}
+	return nil, fmt.Errorf("unsupported report compression %s", compression)
+}
@@ -0,0 +1,186 @@
+package report
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sort"
+	"strings"
+)
+
+type Change int
+
+const (
+	ChangeUnchanged Change = iota
+	ChangeAdded
+	ChangeRemoved
+	ChangeModified
+)
+
+// ValueDiff compares the recommendations of a resource between two reports,
+// Delta is in cores for cpu and in bytes for memory.
+type ValueDiff struct {
+	Base   string
+	Target string
+	Delta  float64
+}
+
+func (d ValueDiff) changed() bool {
+	return d.Base != d.Target
+}
+
+type ContainerDiff struct {
+	Name          string
+	Change        Change
+	CPURequest    ValueDiff
+	CPULimit      ValueDiff
+	MemoryRequest ValueDiff
+	MemoryLimit   ValueDiff
+}
+
+type WorkloadDiff struct {
+	Kind       string
+	Namespace  string
+	Name       string
+	Change     Change
+	Containers []ContainerDiff
+
+	BaseSavings   float64
+	TargetSavings float64
+}
+
+// Key identifies the workload within a report, same as Workload.Key
+func (d WorkloadDiff) Key() string {
+	return d.Kind + "/" + d.Namespace + "/" + d.Name
+}
+
+func (d WorkloadDiff) SavingsDelta() float64 {
+	return d.TargetSavings - d.BaseSavings
+}
+
+// Diff returns the workloads which were added, removed or had their recommendations changed between base and target
+func Diff(base, target []Workload) []WorkloadDiff {
+	baseByKey := make(map[string]Workload)
+	for _, w := range base {
+		baseByKey[w.Key()] = w
+	}
+	targetByKey := make(map[string]Workload)
+	for _, w := range target {
+		targetByKey[w.Key()] = w
+	}
+
+	var diffs []WorkloadDiff
+	for key, t := range targetByKey {
+		b, ok := baseByKey[key]
+		if !ok {
+			diffs = append(diffs, diffWorkload(Workload{}, t, ChangeAdded))
+			continue
+		}
+		diff := diffWorkload(b, t, ChangeUnchanged)
+		if len(diff.Containers) > 0 || diff.SavingsDelta() != 0 {
+			diff.Change = ChangeModified
+			diffs = append(diffs, diff)
+		}
+	}
+	for key, b := range baseByKey {
+		if _, ok := targetByKey[key]; !ok {
+			diffs = append(diffs, diffWorkload(b, Workload{}, ChangeRemoved))
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Key() < diffs[j].Key()
+	})
+	return diffs
+}
+
+// diffWorkload compares two versions of a workload, one of them is empty when the workload was added or removed
+func diffWorkload(base, target Workload, change Change) WorkloadDiff {
+	identity := target
+	if change == ChangeRemoved {
+		identity = base
+	}
+	diff := WorkloadDiff{
+		Kind:          identity.Kind,
+		Namespace:     identity.Namespace,
+		Name:          identity.Name,
+		Change:        change,
+		BaseSavings:   base.Savings(),
+		TargetSavings: target.Savings(),
+	}
+
+	baseContainers := make(map[string]Container)
+	for _, c := range base.Containers {
+		baseContainers[c.Name] = c
+	}
+	targetContainers := make(map[string]Container)
+	for _, c := range target.Containers {
+		targetContainers[c.Name] = c
+	}
+
+	for name, t := range targetContainers {
+		b, ok := baseContainers[name]
+		containerChange := ChangeModified
+		if !ok {
+			containerChange = ChangeAdded
+		}
+		containerDiff := diffContainer(name, b, t, containerChange)
+		if containerChange == ChangeAdded || containerDiff.changed() {
+			diff.Containers = append(diff.Containers, containerDiff)
+		}
+	}
+	for name, b := range baseContainers {
+		if _, ok := targetContainers[name]; !ok {
+			diff.Containers = append(diff.Containers, diffContainer(name, b, Container{}, ChangeRemoved))
+		}
+	}
+
+	sort.Slice(diff.Containers, func(i, j int) bool {
+		return diff.Containers[i].Name < diff.Containers[j].Name
+	})
+	return diff
+}
+
+func diffContainer(name string, base, target Container, change Change) ContainerDiff {
+	return ContainerDiff{
+		Name:          name,
+		Change:        change,
+		CPURequest:    diffValue(base.CPURequest.Recommended, target.CPURequest.Recommended, ParseCPU),
+		CPULimit:      diffValue(base.CPULimit.Recommended, target.CPULimit.Recommended, ParseCPU),
+		MemoryRequest: diffValue(base.MemoryRequest.Recommended, target.MemoryRequest.Recommended, ParseMemory),
+		MemoryLimit:   diffValue(base.MemoryLimit.Recommended, target.MemoryLimit.Recommended, ParseMemory),
+	}
+}
+
+func (d ContainerDiff) changed() bool {
+	return d.CPURequest.changed() || d.CPULimit.changed() || d.MemoryRequest.changed() || d.MemoryLimit.changed()
+}
+
+func diffValue(base, target string, parse func(string) float64) ValueDiff {
+	return ValueDiff{
+		Base:   base,
+		Target: target,
+		Delta:  parse(target) - parse(base),
+	}
+}
+
+// ParseCPU reads cpu values like "0.5 core" as a number of cores, anything unparsable counts as zero
+func ParseCPU(value string) float64 {
+	value = strings.ToLower(strings.TrimSpace(value))
+	value = strings.TrimSuffix(value, " cores")
+	value = strings.TrimSuffix(value, " core")
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0
+	}
+	return q.AsApproximateFloat64()
+}
+
+// ParseMemory reads memory values like "512 MiB" or "1.5 GB" as a number of bytes, anything unparsable counts as zero
+func ParseMemory(value string) float64 {
+	value = strings.ReplaceAll(strings.TrimSpace(value), " ", "")
+	value = strings.NewReplacer("KiB", "Ki", "KB", "k", "MiB", "Mi", "MB", "M", "GiB", "Gi", "GB", "G", "TiB", "Ti", "TB", "T").Replace(value)
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0
+	}
+	return q.AsApproximateFloat64()
+}
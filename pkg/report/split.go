@@ -0,0 +1,76 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kaytu-io/kaytu/view"
+	"sort"
+	"strings"
+)
+
+// ErrNoKinds is returned for an aggregate report none of whose results has the kind of a single-kind command, which
+// means the kinds could not be read rather than that the cluster has no workloads
+var ErrNoKinds = errors.New("no result of the aggregate report has a known kind")
+
+// AggregateCommand reports the workloads of every kind the single-kind commands report
+const AggregateCommand = "kubernetes"
+
+// SubReportCommands returns the single-kind commands whose reports can be derived from the aggregate report
+func SubReportCommands() []string {
+	commands := make([]string, 0, len(commandKinds))
+	for command := range commandKinds {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+func IsSubReportCommand(command string) bool {
+	_, ok := commandKinds[command]
+	return ok
+}
+
+// Split divides the aggregate report into the reports of the single-kind commands. The results are copied as they
+// are, so fields view.PluginResult does not know are kept. Every single-kind command gets a report, an empty one when
+// the aggregate has no workload of its kind, unless no result maps to any of them.
+func Split(content []byte) (map[string][]byte, error) {
+	var results []json.RawMessage
+	if err := json.Unmarshal(content, &results); err != nil {
+		return nil, err
+	}
+
+	split := make(map[string][]json.RawMessage)
+	for command := range commandKinds {
+		split[command] = []json.RawMessage{}
+	}
+	mapped := 0
+	for _, raw := range results {
+		var result view.PluginResult
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return nil, err
+		}
+		kind := resultKind(AggregateCommand, result)
+		for command, commandKind := range commandKinds {
+			if strings.EqualFold(kind, commandKind) {
+				split[command] = append(split[command], raw)
+				mapped++
+				break
+			}
+		}
+	}
+
+	if len(results) > 0 && mapped == 0 {
+		return nil, fmt.Errorf("%w: %d results", ErrNoKinds, len(results))
+	}
+
+	reports := make(map[string][]byte, len(split))
+	for command, commandResults := range split {
+		report, err := json.Marshal(commandResults)
+		if err != nil {
+			return nil, err
+		}
+		reports[command] = report
+	}
+	return reports, nil
+}
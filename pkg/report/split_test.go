@@ -0,0 +1,42 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	aggregate := []byte(`[
+		{"properties": {"kind": "Deployment", "name": "api", "namespace": "default"}, "resources": []},
+		{"properties": {"kind": "pod", "name": "debug", "namespace": "default"}, "resources": []},
+		{"properties": {"kind": "CronJob", "name": "backup", "namespace": "default"}, "resources": []}
+	]`)
+	reports, err := Split(aggregate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != len(commandKinds) {
+		t.Fatalf("got %d reports, want one per single-kind command", len(reports))
+	}
+	for command, want := range map[string]int{"kubernetes-deployments": 1, "kubernetes-pods": 1, "kubernetes-jobs": 0} {
+		var results []json.RawMessage
+		if err := json.Unmarshal(reports[command], &results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != want {
+			t.Errorf("got %d results for %s, want %d", len(results), command, want)
+		}
+	}
+
+	// results whose kind cannot be read must not replace every report with an empty one
+	_, err = Split([]byte(`[{"properties": {"name": "api"}, "resources": []}]`))
+	if !errors.Is(err, ErrNoKinds) {
+		t.Errorf("got %v, want ErrNoKinds", err)
+	}
+
+	reports, err = Split([]byte(`[]`))
+	if err != nil || string(reports["kubernetes-pods"]) != "[]" {
+		t.Errorf("got %s and %v for an empty report", reports["kubernetes-pods"], err)
+	}
+}
@@ -0,0 +1,455 @@
+package report
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kaytu-io/kaytu-agent/config"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry describes a report kept in the history of a command
+type Entry struct {
+	Command   string
+	JobID     uint
+	Size      int64
+	CreatedAt time.Time
+	// CustomParameters is set for reports of jobs that overrode the agent configuration
+	CustomParameters bool
+}
+
+// ErrNotFound is returned for a report that is not stored
+var ErrNotFound = errors.New("report not found")
+
+// ErrInvalidCommand is returned for a command whose reports would be kept outside the output directory
+var ErrInvalidCommand = errors.New("invalid command")
+
+// customSuffix tags the reports of jobs triggered with parameters so they are not confused with the canonical ones
+const customSuffix = ".custom.json"
+
+// Store keeps the reports in the agent database, or in filesystem mode it keeps the latest report of each command
+// at out-<command>.json and a copy of every successful report at <command>/<jobID>.json, both inside the output
+// directory. Reports of jobs with custom parameters never become the latest report, on the filesystem they are kept
+// at <command>/<jobID>.custom.json.
+type Store struct {
+	logger *zap.Logger
+	cfg    *config.Config
+	repo   database.ReportsRepo
+}
+
+func New(logger *zap.Logger, cfg *config.Config, repo database.ReportsRepo) *Store {
+	return &Store{
+		logger: logger,
+		cfg:    cfg,
+		repo:   repo,
+	}
+}
+
+// Encode prepares content to be stored in the database, compressed and with its hash
+func (s *Store) Encode(command string, customParameters bool, content []byte) (*database.Report, error) {
+	return encode(command, customParameters, s.cfg.GetReportCompression(), content)
+}
+
+func (s *Store) LatestPath(command string) string {
+	return filepath.Join(s.cfg.GetOutputDirectory(), fmt.Sprintf("out-%s.json", command))
+}
+
+func (s *Store) HistoryPath(command string, jobID uint) string {
+	return filepath.Join(s.cfg.GetReportHistoryDirectory(command), fmt.Sprintf("%d.json", jobID))
+}
+
+func (s *Store) CustomHistoryPath(command string, jobID uint) string {
+	return filepath.Join(s.cfg.GetReportHistoryDirectory(command), fmt.Sprintf("%d%s", jobID, customSuffix))
+}
+
+// checkCommand makes sure the latest report and the history directory of the command sit right inside the output
+// directory, so a command like ../x can't reach other files
+func (s *Store) checkCommand(command string) error {
+	outputDirectory, err := filepath.Abs(s.cfg.GetOutputDirectory())
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{s.LatestPath(command), s.cfg.GetReportHistoryDirectory(command)} {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if command == "" || filepath.Dir(path) != outputDirectory {
+			return fmt.Errorf("%w %q", ErrInvalidCommand, command)
+		}
+	}
+	return nil
+}
+
+// Path returns where the report of the given job is stored, jobID 0 points to the latest report
+func (s *Store) Path(command string, jobID uint) string {
+	if jobID == 0 {
+		return s.LatestPath(command)
+	}
+	if _, err := os.Stat(s.HistoryPath(command, jobID)); os.IsNotExist(err) {
+		if _, err := os.Stat(s.CustomHistoryPath(command, jobID)); err == nil {
+			return s.CustomHistoryPath(command, jobID)
+		}
+	}
+	return s.HistoryPath(command, jobID)
+}
+
+func (s *Store) entryPath(entry Entry) string {
+	if entry.CustomParameters {
+		return s.CustomHistoryPath(entry.Command, entry.JobID)
+	}
+	return s.HistoryPath(entry.Command, entry.JobID)
+}
+
+// Read returns the report of the given job, jobID 0 returns the latest report
+func (s *Store) Read(ctx context.Context, command string, jobID uint) ([]byte, error) {
+	if err := s.checkCommand(command); err != nil {
+		return nil, err
+	}
+	if !s.cfg.StoresReportsInDatabase() {
+		content, err := os.ReadFile(s.Path(command, jobID))
+		return content, notFound(err)
+	}
+
+	report, err := s.repo.GetReport(ctx, command, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if report == nil {
+		return nil, ErrNotFound
+	}
+	return decode(report)
+}
+
+// Open returns a reader over the report of the given job, reports in the database are decompressed as they are read
+func (s *Store) Open(ctx context.Context, command string, jobID uint) (io.ReadCloser, error) {
+	if err := s.checkCommand(command); err != nil {
+		return nil, err
+	}
+	if !s.cfg.StoresReportsInDatabase() {
+		f, err := os.Open(s.Path(command, jobID))
+		return f, notFound(err)
+	}
+
+	report, err := s.repo.GetReport(ctx, command, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if report == nil {
+		return nil, ErrNotFound
+	}
+	return openDecoded(report)
+}
+
+// WriteLatest replaces the latest report of the command with content
+func (s *Store) WriteLatest(command string, content []byte) error {
+	if err := s.checkCommand(command); err != nil {
+		return err
+	}
+	err := os.MkdirAll(s.cfg.GetOutputDirectory(), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	dirtyPath := s.LatestPath(command) + ".tmp"
+	err = os.WriteFile(dirtyPath, content, os.ModePerm)
+	if err != nil {
+		os.Remove(dirtyPath)
+		return err
+	}
+	return os.Rename(dirtyPath, s.LatestPath(command))
+}
+
+// Archive copies the latest report of the command into its history under the given job id
+// and prunes the history down to the configured retention count.
+func (s *Store) Archive(command string, jobID uint) error {
+	if err := s.checkCommand(command); err != nil {
+		return err
+	}
+	err := os.MkdirAll(s.cfg.GetReportHistoryDirectory(command), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(s.LatestPath(command))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dirtyPath := s.HistoryPath(command, jobID) + ".tmp"
+	dst, err := os.OpenFile(dirtyPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	dst.Close()
+	if err != nil {
+		os.Remove(dirtyPath)
+		return err
+	}
+	err = os.Rename(dirtyPath, s.HistoryPath(command, jobID))
+	if err != nil {
+		return err
+	}
+
+	return s.pruneFiles(command)
+}
+
+// ArchiveCustom moves the report of a job with custom parameters from path into the history of the command
+func (s *Store) ArchiveCustom(command string, jobID uint, path string) error {
+	if err := s.checkCommand(command); err != nil {
+		return err
+	}
+	err := os.MkdirAll(s.cfg.GetReportHistoryDirectory(command), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path, s.CustomHistoryPath(command, jobID))
+	if err != nil {
+		return err
+	}
+
+	return s.pruneFiles(command)
+}
+
+// DeleteFiles removes the report of the job from the history on the filesystem
+func (s *Store) DeleteFiles(command string, jobID uint) error {
+	if err := s.checkCommand(command); err != nil {
+		return err
+	}
+	for _, path := range []string{s.HistoryPath(command, jobID), s.CustomHistoryPath(command, jobID)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the reports in the history of the command, newest first
+func (s *Store) List(ctx context.Context, command string) ([]Entry, error) {
+	if err := s.checkCommand(command); err != nil {
+		return nil, err
+	}
+	if !s.cfg.StoresReportsInDatabase() {
+		return s.listFiles(command)
+	}
+
+	reports, err := s.repo.ListReports(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(reports))
+	for _, report := range reports {
+		entries = append(entries, Entry{
+			Command:   command,
+			JobID:     report.OptimizationJobID,
+			Size:      report.Size,
+			CreatedAt: report.GeneratedAt,
+
+			CustomParameters: report.CustomParameters,
+		})
+	}
+	return entries, nil
+}
+
+func (s *Store) listFiles(command string) ([]Entry, error) {
+	files, err := os.ReadDir(s.cfg.GetReportHistoryDirectory(command))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		custom := strings.HasSuffix(file.Name(), customSuffix)
+		name := strings.TrimSuffix(file.Name(), ".json")
+		if custom {
+			name = strings.TrimSuffix(file.Name(), customSuffix)
+		}
+		jobID, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{
+			Command:   command,
+			JobID:     uint(jobID),
+			Size:      info.Size(),
+			CreatedAt: info.ModTime(),
+
+			CustomParameters: custom,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].JobID > entries[j].JobID
+	})
+	return entries, nil
+}
+
+// Prune removes the oldest reports of the command beyond the configured retention count. In the database the newest
+// report without custom parameters is the latest report of the command, so it is kept however many custom reports
+// came after it.
+func (s *Store) Prune(ctx context.Context, command string) error {
+	if err := s.checkCommand(command); err != nil {
+		return err
+	}
+	if !s.cfg.StoresReportsInDatabase() {
+		return s.pruneFiles(command)
+	}
+	if s.cfg.ReportRetentionCount <= 0 {
+		return nil
+	}
+
+	reports, err := s.repo.ListReports(ctx, command)
+	if err != nil {
+		return err
+	}
+	if len(reports) <= s.cfg.ReportRetentionCount {
+		return nil
+	}
+
+	latestKept := false
+	for _, report := range reports[:s.cfg.ReportRetentionCount] {
+		if !report.CustomParameters {
+			latestKept = true
+			break
+		}
+	}
+
+	var ids []uint
+	for _, report := range reports[s.cfg.ReportRetentionCount:] {
+		if !latestKept && !report.CustomParameters {
+			latestKept = true
+			continue
+		}
+		s.logger.Info("pruning report", zap.String("command", command), zap.Uint("jobID", report.OptimizationJobID))
+		ids = append(ids, report.ID)
+	}
+	return s.repo.DeleteReports(ctx, ids)
+}
+
+func (s *Store) pruneFiles(command string) error {
+	if s.cfg.ReportRetentionCount <= 0 {
+		return nil
+	}
+
+	entries, err := s.listFiles(command)
+	if err != nil {
+		return err
+	}
+	if len(entries) <= s.cfg.ReportRetentionCount {
+		return nil
+	}
+
+	for _, entry := range entries[s.cfg.ReportRetentionCount:] {
+		s.logger.Info("pruning report", zap.String("command", command), zap.Uint("jobID", entry.JobID))
+		if err := os.Remove(s.entryPath(entry)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportFiles moves the reports an agent kept in the output directory into the database the first time it runs with
+// database storage, a command that already has reports in the database is left alone. The files are left in place.
+func (s *Store) ImportFiles(ctx context.Context) error {
+	if !s.cfg.StoresReportsInDatabase() {
+		return nil
+	}
+	for command := range s.cfg.Commands {
+		if err := s.importFiles(ctx, command); err != nil {
+			return fmt.Errorf("failed to import reports of %s: %w", command, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) importFiles(ctx context.Context, command string) error {
+	if err := s.checkCommand(command); err != nil {
+		return err
+	}
+	reports, err := s.repo.ListReports(ctx, command)
+	if err != nil || len(reports) > 0 {
+		return err
+	}
+	entries, err := s.listFiles(command)
+	if err != nil {
+		return err
+	}
+
+	imported := 0
+	latestImported := false
+	// oldest first, in the order the reports were produced
+	for idx := len(entries) - 1; idx >= 0; idx-- {
+		ok, err := s.importFile(ctx, command, s.entryPath(entries[idx]), entries[idx].JobID, entries[idx].CustomParameters)
+		if err != nil {
+			return err
+		}
+		if ok {
+			imported++
+			latestImported = latestImported || !entries[idx].CustomParameters
+		}
+	}
+	// the history holds a copy of the latest report, unless it was written by an agent that kept no history
+	if !latestImported {
+		ok, err := s.importFile(ctx, command, s.LatestPath(command), 0, false)
+		if err != nil {
+			return err
+		}
+		if ok {
+			imported++
+		}
+	}
+	if imported > 0 {
+		s.logger.Info("imported reports from the output directory", zap.String("command", command), zap.Int("count", imported))
+	}
+	return nil
+}
+
+func (s *Store) importFile(ctx context.Context, command string, path string, jobID uint, customParameters bool) (bool, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	report, err := s.Encode(command, customParameters, content)
+	if err != nil {
+		return false, err
+	}
+	report.OptimizationJobID = jobID
+	report.GeneratedAt = info.ModTime()
+	return s.repo.ImportReport(ctx, report)
+}
+
+// notFound makes a missing report file an ErrNotFound
+func notFound(err error) error {
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return err
+}
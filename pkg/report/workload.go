@@ -0,0 +1,187 @@
+package report
+
+import (
+	"encoding/json"
+	"github.com/kaytu-io/kaytu/view"
+	"k8s.io/apimachinery/pkg/labels"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ResourceDetail is a resource of a container as it is configured and as kaytu recommends it
+type ResourceDetail struct {
+	Current     string
+	Recommended string
+}
+
+// the keys of view.PluginResult the kubernetes plugin fills for every workload, name and namespace are read the same
+// way by the continuous optimization command
+const (
+	propertyName            = "name"
+	propertyNamespace       = "namespace"
+	propertyKind            = "kind"
+	propertyLabels          = "labels"
+	propertyCurrentCost     = "current_cost"
+	propertyRecommendedCost = "recommended_cost"
+
+	overviewName = "name"
+	// containerOverallSuffix marks the resource row holding the totals of a container
+	containerOverallSuffix = " - Overall"
+
+	detailCPURequest    = "cpu_request"
+	detailCPULimit      = "cpu_limit"
+	detailMemoryRequest = "memory_request"
+	detailMemoryLimit   = "memory_limit"
+)
+
+// commandKinds is the workload kind reported by each single-kind command, only the results of the aggregate command
+// carry a kind of their own
+var commandKinds = map[string]string{
+	"kubernetes-pods":         "Pod",
+	"kubernetes-deployments":  "Deployment",
+	"kubernetes-statefulsets": "StatefulSet",
+	"kubernetes-daemonsets":   "DaemonSet",
+	"kubernetes-jobs":         "Job",
+}
+
+type Container struct {
+	Name          string
+	CPURequest    ResourceDetail
+	CPULimit      ResourceDetail
+	MemoryRequest ResourceDetail
+	MemoryLimit   ResourceDetail
+}
+
+type Workload struct {
+	Kind       string
+	Namespace  string
+	Name       string
+	Labels     map[string]string
+	Containers []Container
+
+	CurrentCost     float64
+	RecommendedCost float64
+}
+
+func (w Workload) Savings() float64 {
+	return w.CurrentCost - w.RecommendedCost
+}
+
+// Key identifies the workload within a report
+func (w Workload) Key() string {
+	return w.Kind + "/" + w.Namespace + "/" + w.Name
+}
+
+// Parse decodes a report, which is what `kaytu optimize --output json` prints
+func Parse(content []byte) ([]view.PluginResult, error) {
+	var results []view.PluginResult
+	if err := json.Unmarshal(content, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Workloads converts the results of a report produced by the given command to typed workloads
+func Workloads(command string, results []view.PluginResult) []Workload {
+	workloads := make([]Workload, 0, len(results))
+	for _, result := range results {
+		workload := Workload{
+			Kind:            resultKind(command, result),
+			Namespace:       result.Properties[propertyNamespace],
+			Name:            result.Properties[propertyName],
+			Labels:          parseLabels(result.Properties[propertyLabels]),
+			CurrentCost:     parseCost(result.Properties[propertyCurrentCost]),
+			RecommendedCost: parseCost(result.Properties[propertyRecommendedCost]),
+		}
+
+		for _, resource := range result.Resources {
+			name := resource.Overview[overviewName]
+			if !strings.HasSuffix(name, containerOverallSuffix) {
+				continue
+			}
+			detail := func(key string) ResourceDetail {
+				value := resource.Details[key]
+				return ResourceDetail{Current: value.Current, Recommended: value.Recommended}
+			}
+			workload.Containers = append(workload.Containers, Container{
+				Name:          strings.TrimSuffix(name, containerOverallSuffix),
+				CPURequest:    detail(detailCPURequest),
+				CPULimit:      detail(detailCPULimit),
+				MemoryRequest: detail(detailMemoryRequest),
+				MemoryLimit:   detail(detailMemoryLimit),
+			})
+		}
+		workloads = append(workloads, workload)
+	}
+	return workloads
+}
+
+// resultKind is the kind of the command for the single-kind commands, and the kind the result carries otherwise
+func resultKind(command string, result view.PluginResult) string {
+	if kind, ok := commandKinds[command]; ok {
+		return kind
+	}
+	return result.Properties[propertyKind]
+}
+
+// Filter selects workloads, empty fields match everything
+type Filter struct {
+	Namespaces []string
+	Kinds      []string
+	NameGlob   string
+	Selector   labels.Selector
+}
+
+func (f Filter) Match(w Workload) bool {
+	if len(f.Namespaces) > 0 && !containsFold(f.Namespaces, w.Namespace) {
+		return false
+	}
+	if len(f.Kinds) > 0 && !containsFold(f.Kinds, w.Kind) {
+		return false
+	}
+	if f.NameGlob != "" {
+		if matched, _ := path.Match(f.NameGlob, w.Name); !matched {
+			return false
+		}
+	}
+	if f.Selector != nil && !f.Selector.Matches(labels.Set(w.Labels)) {
+		return false
+	}
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLabels reads labels written as comma separated key=value pairs
+func parseLabels(value string) map[string]string {
+	if value == "" {
+		return nil
+	}
+	set, err := labels.ConvertSelectorToLabelsMap(value)
+	if err != nil {
+		return nil
+	}
+	return set
+}
+
+// parseCost reads costs like "$1,234.5" or "12.3 $/month", anything unparsable counts as zero
+func parseCost(value string) float64 {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return 0
+	}
+	number := strings.NewReplacer("$", "", ",", "").Replace(fields[0])
+	cost, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0
+	}
+	return cost
+}
@@ -0,0 +1,52 @@
+package report
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWorkloads(t *testing.T) {
+	content, err := os.ReadFile("testdata/kubernetes-deployments.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := Parse(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workloads := Workloads("kubernetes-deployments", results)
+	if len(workloads) != 2 {
+		t.Fatalf("got %d workloads, want 2", len(workloads))
+	}
+
+	api := workloads[0]
+	if api.Key() != "Deployment/default/api" {
+		t.Errorf("got key %s, want Deployment/default/api", api.Key())
+	}
+	if api.Labels["app"] != "api" || api.Labels["tier"] != "backend" {
+		t.Errorf("got labels %v", api.Labels)
+	}
+	if api.CurrentCost != 12.5 || api.RecommendedCost != 4.25 || api.Savings() != 8.25 {
+		t.Errorf("got costs %v and %v", api.CurrentCost, api.RecommendedCost)
+	}
+	// only the overall row of a container is read, the rows of its pods are not
+	if len(api.Containers) != 1 {
+		t.Fatalf("got %d containers, want 1", len(api.Containers))
+	}
+	server := api.Containers[0]
+	if server.Name != "server" {
+		t.Errorf("got container %s, want server", server.Name)
+	}
+	if server.CPURequest != (ResourceDetail{Current: "1 Core", Recommended: "0.25 Core"}) {
+		t.Errorf("got cpu request %+v", server.CPURequest)
+	}
+	if server.MemoryLimit != (ResourceDetail{Current: "2 GiB", Recommended: "512 MiB"}) {
+		t.Errorf("got memory limit %+v", server.MemoryLimit)
+	}
+
+	worker := workloads[1]
+	if worker.Key() != "Deployment/jobs/worker" || worker.Labels != nil || len(worker.Containers) != 0 {
+		t.Errorf("got %+v", worker)
+	}
+}
@@ -0,0 +1,66 @@
+package scheduler
+
+import (
+	"context"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"github.com/kaytu-io/kaytu-agent/pkg/report"
+	"go.uber.org/zap"
+)
+
+// derivesReport tells whether the report of the command is split off the aggregate report instead of being run
+func (s *Service) derivesReport(command string) bool {
+	return s.cfg.DeriveSubReports && report.IsSubReportCommand(command)
+}
+
+// deriveSubReports splits the report of the aggregate job into the reports of the enabled single-kind commands,
+// each of them gets a succeeded job of its own so GetReport, ListJobs and the report history work as if they ran
+func (s *Service) deriveSubReports(ctx context.Context, parent *database.OptimizationJob) {
+	// the report of the parent job, another run of the aggregate command may have stored a later one already
+	content, err := s.reports.Read(ctx, parent.Command, parent.ID)
+	if err != nil {
+		s.logger.Error("failed to read aggregate report", zap.Uint("jobID", parent.ID), zap.Error(err))
+		return
+	}
+	reports, err := report.Split(content)
+	if err != nil {
+		s.logger.Error("failed to split aggregate report", zap.Uint("jobID", parent.ID), zap.Error(err))
+		return
+	}
+
+	for _, command := range report.SubReportCommands() {
+		if _, ok := s.cfg.GetCommand(command); !ok {
+			continue
+		}
+		job := &database.OptimizationJob{
+			Command:     command,
+			ParentJobID: &parent.ID,
+		}
+		if err := s.storeDerivedReport(ctx, job, reports[command]); err != nil {
+			s.logger.Error("failed to store derived report", zap.String("command", command), zap.Error(err))
+			continue
+		}
+		s.logger.Info("derived report", zap.String("command", command), zap.Uint("jobID", job.ID), zap.Uint("parentJobID", parent.ID))
+	}
+}
+
+// storeDerivedReport creates the succeeded job of a derived report and stores the report with it
+func (s *Service) storeDerivedReport(ctx context.Context, job *database.OptimizationJob, content []byte) error {
+	if s.cfg.StoresReportsInDatabase() {
+		record, err := s.reports.Encode(job.Command, false, content)
+		if err != nil {
+			return err
+		}
+		if err := s.optimizationJobsRepo.CreateDerivedOptimizationJob(ctx, job, record); err != nil {
+			return err
+		}
+		return s.reports.Prune(ctx, job.Command)
+	}
+
+	if err := s.reports.WriteLatest(job.Command, content); err != nil {
+		return err
+	}
+	if err := s.optimizationJobsRepo.CreateDerivedOptimizationJob(ctx, job, nil); err != nil {
+		return err
+	}
+	return s.reports.Archive(job.Command, job.ID)
+}
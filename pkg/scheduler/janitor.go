@@ -0,0 +1,258 @@
+package scheduler
+
+import (
+	"context"
+	"github.com/kaytu-io/kaytu-agent/config"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"github.com/kaytu-io/kaytu-agent/pkg/report"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Janitor deletes the history the retention policies do not keep and the files that crashed runs left behind
+type Janitor struct {
+	logger               *zap.Logger
+	cfg                  *config.Config
+	db                   *database.AgentDatabase
+	optimizationJobsRepo database.OptimizationJobsRepo
+	reports              *report.Store
+}
+
+func NewJanitor(logger *zap.Logger, cfg *config.Config, db *database.AgentDatabase, optimizationJobsRepo database.OptimizationJobsRepo,
+	reports *report.Store) *Janitor {
+	return &Janitor{
+		logger:               logger,
+		cfg:                  cfg,
+		db:                   db,
+		optimizationJobsRepo: optimizationJobsRepo,
+		reports:              reports,
+	}
+}
+
+// Run cleans the working directory of this agent on every tick until ctx is done
+func (j *Janitor) Run(ctx context.Context) {
+	j.every(ctx, j.cleanFiles)
+}
+
+// Lead applies the retention policies to the database and vacuums it on every tick until ctx is done, which is when
+// the agent shuts down or loses its leadership, so that a single replica cleans a shared database
+func (j *Janitor) Lead(ctx context.Context) {
+	go j.every(database.WithActor(ctx, database.ActorJanitor), j.cleanDatabase)
+}
+
+func (j *Janitor) every(ctx context.Context, clean func(ctx context.Context)) {
+	ticker := time.NewTicker(j.cfg.Retention.GetInterval())
+	defer ticker.Stop()
+
+	clean(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			clean(ctx)
+		}
+	}
+}
+
+func (j *Janitor) cleanDatabase(ctx context.Context) {
+	if err := j.deleteExpiredJobs(ctx); err != nil {
+		j.logger.Error("failed to delete expired optimization jobs", zap.Error(err))
+	}
+	if j.cfg.Retention.VacuumIntervalSeconds > 0 && j.cfg.GetDatabaseDialect() == config.DatabaseDialectSQLite {
+		if err := j.vacuum(ctx); err != nil {
+			j.logger.Error("failed to vacuum database", zap.Error(err))
+		}
+	}
+}
+
+func (j *Janitor) cleanFiles(context.Context) {
+	if j.cfg.Retention.DeleteOrphanedFiles {
+		if err := j.deleteOrphanedFiles(); err != nil {
+			j.logger.Error("failed to delete orphaned files", zap.Error(err))
+		}
+	}
+	if j.cfg.Retention.MaxOutputDirectoryMB > 0 {
+		if err := j.capOutputDirectory(); err != nil {
+			j.logger.Error("failed to cap the output directory", zap.Error(err))
+		}
+	}
+}
+
+// vacuum vacuums the database once the vacuum interval has passed since the last vacuum, which is kept in the database
+// so that restarts do not put it off
+func (j *Janitor) vacuum(ctx context.Context) error {
+	lastVacuum, err := j.db.LastVacuum(ctx)
+	if err != nil {
+		return err
+	}
+	if lastVacuum != nil && time.Since(*lastVacuum) < j.cfg.Retention.GetVacuumInterval() {
+		return nil
+	}
+
+	start := time.Now()
+	if err := j.db.Vacuum(ctx); err != nil {
+		return err
+	}
+	j.logger.Info("vacuumed database", zap.Duration("took", time.Since(start)))
+	return nil
+}
+
+// deleteExpiredJobs deletes the finished jobs the retention policies do not keep, together with their reports
+func (j *Janitor) deleteExpiredJobs(ctx context.Context) error {
+	var createdBefore time.Time
+	if j.cfg.Retention.MaxJobAgeDays > 0 {
+		createdBefore = time.Now().AddDate(0, 0, -j.cfg.Retention.MaxJobAgeDays)
+	}
+	if createdBefore.IsZero() && j.cfg.Retention.KeepJobsPerCommand <= 0 {
+		return nil
+	}
+
+	jobs, err := j.optimizationJobsRepo.ListExpiredOptimizationJobs(ctx, j.cfg.Retention.KeepJobsPerCommand, createdBefore)
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return j.deleteExpiredEvents(ctx, createdBefore)
+	}
+
+	ids := make([]uint, 0, len(jobs))
+	for _, job := range jobs {
+		ids = append(ids, job.ID)
+	}
+	if err := j.optimizationJobsRepo.DeleteOptimizationJobs(ctx, ids); err != nil {
+		return err
+	}
+	j.logger.Info("deleted expired optimization jobs", zap.Int("count", len(ids)), zap.Uints("ids", ids))
+
+	if !j.cfg.StoresReportsInDatabase() {
+		for _, job := range jobs {
+			if err := j.reports.DeleteFiles(job.Command, job.ID); err != nil {
+				j.logger.Error("failed to delete report", zap.String("command", job.Command), zap.Uint("jobID", job.ID), zap.Error(err))
+			}
+		}
+	}
+	return j.deleteExpiredEvents(ctx, createdBefore)
+}
+
+// deleteExpiredEvents deletes the events that recorded the deletion of jobs once they are as old as the jobs the
+// retention policies keep
+func (j *Janitor) deleteExpiredEvents(ctx context.Context, createdBefore time.Time) error {
+	if createdBefore.IsZero() {
+		return nil
+	}
+	return j.optimizationJobsRepo.DeleteOptimizationJobEvents(ctx, createdBefore)
+}
+
+// deleteOrphanedFiles deletes the reports kaytu left in the worker directories, and the temporary files and the reports
+// of interrupted runs of older agents left in the output directory. A file is orphaned once it is older than any run
+// may take, so files of running jobs are left alone.
+func (j *Janitor) deleteOrphanedFiles() error {
+	before := time.Now().Add(-j.cfg.GetLongestRunTimeout())
+
+	orphaned := func(dir string, match func(name string) bool) error {
+		return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if entry.IsDir() || !match(entry.Name()) {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil || !info.ModTime().Before(before) {
+				return nil
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			j.logger.Info("deleted orphaned file", zap.String("path", path), zap.Int64("size", info.Size()), zap.Time("modifiedAt", info.ModTime()))
+			return nil
+		})
+	}
+
+	err := orphaned(j.cfg.GetWorkersDirectory(), func(name string) bool {
+		return strings.HasPrefix(name, "out-") && strings.HasSuffix(name, ".json")
+	})
+	if err != nil {
+		return err
+	}
+	return orphaned(j.cfg.GetOutputDirectory(), func(name string) bool {
+		if strings.HasSuffix(name, ".tmp") {
+			return true
+		}
+		// agents before the worker directories wrote the running report next to the latest one
+		if !strings.HasPrefix(name, "out-") || !strings.HasSuffix(name, "-dirty.json") {
+			return false
+		}
+		_, isLatestReport := j.cfg.GetCommand(strings.TrimSuffix(strings.TrimPrefix(name, "out-"), ".json"))
+		return !isLatestReport
+	})
+}
+
+// capOutputDirectory deletes the oldest reports in the history until the output directory fits its size cap,
+// the latest report of each command is kept
+func (j *Janitor) capOutputDirectory() error {
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var total int64
+	var history []file
+	outputDirectory := j.cfg.GetOutputDirectory()
+	err := filepath.WalkDir(outputDirectory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		// the latest reports sit at the top of the output directory, the history in a directory per command
+		if filepath.Dir(path) != outputDirectory {
+			history = append(history, file{path: path, size: info.Size(), modTime: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	limit := j.cfg.Retention.GetMaxOutputDirectoryBytes()
+	if total <= limit {
+		return nil
+	}
+	sort.Slice(history, func(a, b int) bool {
+		return history[a].modTime.Before(history[b].modTime)
+	})
+	for _, f := range history {
+		if total <= limit {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= f.size
+		j.logger.Info("deleted report to cap the output directory", zap.String("path", f.path), zap.Int64("size", f.size))
+	}
+	if total > limit {
+		j.logger.Warn("output directory is still over its size cap", zap.Int64("size", total), zap.Int64("limit", limit))
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"go.uber.org/zap"
+	"time"
+)
+
+// errLeaseLost is the cause of a running job's context being cancelled because its lease expired or another agent owns it
+var errLeaseLost = errors.New("optimization job lease was lost")
+
+// heartbeat renews the lease of the job until ctx is done, the run is stopped once the job turns out not to be ours anymore
+func (s *Service) heartbeat(ctx context.Context, job *database.OptimizationJob, cancelRun context.CancelCauseFunc) {
+	ticker := time.NewTicker(s.cfg.GetOptimizationJobHeartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			owned, err := s.optimizationJobsRepo.RenewOptimizationJobLease(ctx, job.ID, s.instanceID)
+			if err != nil {
+				// the lease timeout leaves room for a few failed renewals
+				s.logger.Error("failed to renew optimization job lease", zap.Uint("id", job.ID), zap.Error(err))
+				continue
+			}
+			if !owned {
+				s.logger.Warn("lost optimization job lease, stopping the run", zap.Uint("id", job.ID), zap.String("command", job.Command))
+				cancelRun(errLeaseLost)
+				return
+			}
+		}
+	}
+}
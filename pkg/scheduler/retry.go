@@ -0,0 +1,21 @@
+package scheduler
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// retryDelay is how long a job waits before its next attempt after the given attempt failed. The delay doubles with
+// every attempt up to the configured maximum, and a random half of it is jittered so failed jobs do not retry in lockstep.
+func (s *Service) retryDelay(attempt int) time.Duration {
+	maxDelay := s.cfg.GetOptimizationJobRetryMaxDelay()
+	delay := s.cfg.GetOptimizationJobRetryBaseDelay()
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -0,0 +1,137 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"github.com/kaytu-io/kaytu-agent/pkg/report"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+	"time"
+)
+
+// maxSchedulePollInterval is the resolution of cron schedules
+const maxSchedulePollInterval = time.Minute
+
+type commandSchedule struct {
+	spec     string
+	schedule cron.Schedule
+}
+
+// parseSchedules builds the schedule of every command from its cron expression and time zone,
+// commands without an expression run on the fixed schedule interval. Commands whose report is derived
+// from the aggregate report never run on their own, so a schedule on them is rejected.
+func (s *Service) parseSchedules() (map[string]commandSchedule, error) {
+	interval := s.cfg.GetOptimizationJobScheduleInterval()
+	schedules := make(map[string]commandSchedule)
+	for _, command := range s.cfg.GetCommandNames() {
+		commandCfg := s.cfg.Commands[command]
+		if s.derivesReport(command) {
+			if commandCfg.Schedule != "" {
+				return nil, fmt.Errorf("command %s has a schedule but its report is derived from %s, remove the schedule or disable deriveSubReports",
+					command, report.AggregateCommand)
+			}
+			continue
+		}
+		if commandCfg.Schedule == "" {
+			schedules[command] = commandSchedule{
+				spec:     fmt.Sprintf("@every %s", interval.String()),
+				schedule: cron.Every(interval),
+			}
+			continue
+		}
+
+		timezone := commandCfg.Timezone
+		if timezone == "" {
+			timezone = "UTC"
+		}
+		spec := fmt.Sprintf("CRON_TZ=%s %s", timezone, commandCfg.Schedule)
+		schedule, err := cron.ParseStandard(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule for command %s: %w", command, err)
+		}
+		schedules[command] = commandSchedule{
+			spec:     spec,
+			schedule: schedule,
+		}
+	}
+	return schedules, nil
+}
+
+func (s *Service) schedulePollInterval() time.Duration {
+	interval := s.cfg.GetOptimizationJobScheduleInterval()
+	if interval > maxSchedulePollInterval {
+		return maxSchedulePollInterval
+	}
+	return interval
+}
+
+// enqueueDueCommands enqueues every command whose next fire time has passed and persists its next fire time
+func (s *Service) enqueueDueCommands(ctx context.Context, now time.Time) {
+	for _, command := range s.cfg.GetCommandNames() {
+		if _, ok := s.schedules[command]; !ok {
+			// the report of the command is derived from the aggregate report
+			continue
+		}
+		if err := s.enqueueIfDue(ctx, command, now); err != nil {
+			s.logger.Error("failed to run command schedule", zap.Error(err), zap.String("command", command))
+		}
+	}
+}
+
+func (s *Service) enqueueIfDue(ctx context.Context, command string, now time.Time) error {
+	cs := s.schedules[command]
+	row, err := s.commandSchedulesRepo.GetCommandSchedule(ctx, command)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	if row == nil || row.Schedule != cs.spec {
+		changed = true
+		var lastFireAt *time.Time
+		if row != nil {
+			lastFireAt = row.LastFireAt
+		}
+		row = &database.CommandSchedule{
+			Command:    command,
+			Schedule:   cs.spec,
+			LastFireAt: lastFireAt,
+			NextFireAt: cs.schedule.Next(now),
+		}
+		// commands that never ran are enqueued right away instead of waiting for their first fire time
+		job, err := s.optimizationJobsRepo.GetLatestOptimizationJobByCommand(ctx, command)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			row.NextFireAt = now
+		}
+	}
+
+	if now.Before(row.NextFireAt) {
+		if changed {
+			return s.commandSchedulesRepo.SaveCommandSchedule(ctx, row)
+		}
+		return nil
+	}
+
+	// a command whose job is still queued or running skips this fire, any other failure keeps the schedule where it
+	// is so the next poll tries again
+	err = s.EnqueueOptimization(ctx, command, database.OptimizationJobTriggerSourceSchedule, nil, database.OptimizationJobParameters{})
+	if err != nil && !errors.Is(err, errJobExists) {
+		if changed {
+			if saveErr := s.commandSchedulesRepo.SaveCommandSchedule(ctx, row); saveErr != nil {
+				s.logger.Error("failed to save command schedule", zap.Error(saveErr), zap.String("command", command))
+			}
+		}
+		return fmt.Errorf("failed to enqueue optimization job: %w", err)
+	}
+
+	// missed fire times while the agent was down collapse into this single run
+	row.LastFireAt = &now
+	row.NextFireAt = cs.schedule.Next(now)
+	s.logger.Info("scheduled optimization job", zap.String("command", command), zap.Time("nextFireAt", row.NextFireAt))
+	return s.commandSchedulesRepo.SaveCommandSchedule(ctx, row)
+}
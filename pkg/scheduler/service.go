@@ -7,19 +7,42 @@ import (
 	"github.com/kaytu-io/kaytu-agent/config"
 	"github.com/kaytu-io/kaytu-agent/pkg/database"
 	kaytuCmd "github.com/kaytu-io/kaytu-agent/pkg/kaytu/cmd"
+	"github.com/kaytu-io/kaytu-agent/pkg/report"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var Commands = []string{
-	"kubernetes-pods",
-	"kubernetes-deployments",
-	"kubernetes-statefulsets",
-	"kubernetes-daemonsets",
-	"kubernetes-jobs",
-	"kubernetes",
+// defaultPriorities puts jobs somebody is waiting for ahead of the scheduled ones
+var defaultPriorities = map[database.OptimizationJobTriggerSource]int32{
+	database.OptimizationJobTriggerSourceManual:   100,
+	database.OptimizationJobTriggerSourceWebhook:  50,
+	database.OptimizationJobTriggerSourceSchedule: 0,
+}
+
+// errJobExists is returned when enqueuing a command that already has a job queued or running
+var errJobExists = status.New(codes.InvalidArgument, "optimization job already exists").Err()
+
+// errJobCancelled is the cause of a running job's context being cancelled through CancelJob
+var errJobCancelled = errors.New("optimization job was cancelled")
+
+// jobCancelled is errJobCancelled along with the actor that cancelled the job, so the transition is attributed to them
+type jobCancelled struct {
+	actor string
+}
+
+func (c *jobCancelled) Error() string {
+	return errJobCancelled.Error()
+}
+
+func (c *jobCancelled) Is(target error) bool {
+	return target == errJobCancelled
 }
 
 type Service struct {
@@ -28,36 +51,151 @@ type Service struct {
 	cfg      *config.Config
 
 	optimizationJobsRepo database.OptimizationJobsRepo
+	commandSchedulesRepo database.CommandSchedulesRepo
+	reports              *report.Store
+	// instanceID is stored as the owner of the jobs this agent claims
+	instanceID string
+	schedules  map[string]commandSchedule
+
+	runningJobsMutex sync.Mutex
+	runningJobs      map[uint]context.CancelCauseFunc
+	// workers is done once every worker has stopped picking up jobs
+	workers sync.WaitGroup
+
+	leading              atomic.Bool
+	checkCycleRunning    atomic.Bool
+	scheduleCycleRunning atomic.Bool
+	runningWorkers       atomic.Int32
+
+	// wakeUp tells idle workers there may be queued jobs, prometheusSlots bounds the jobs querying prometheus
+	wakeUp          chan struct{}
+	prometheusSlots chan struct{}
+	claimMutex      sync.Mutex
 }
 
-func New(kaytuCmd *kaytuCmd.KaytuCmd, logger *zap.Logger, cfg *config.Config, optimizationJobsRepo database.OptimizationJobsRepo) *Service {
+func New(kaytuCmd *kaytuCmd.KaytuCmd, logger *zap.Logger, cfg *config.Config, optimizationJobsRepo database.OptimizationJobsRepo,
+	commandSchedulesRepo database.CommandSchedulesRepo, reports *report.Store) *Service {
 	return &Service{
 		kaytuCmd:             kaytuCmd,
 		logger:               logger,
 		cfg:                  cfg,
 		optimizationJobsRepo: optimizationJobsRepo,
+		commandSchedulesRepo: commandSchedulesRepo,
+		reports:              reports,
+		instanceID:           cfg.GetInstanceID(),
+		runningJobs:          make(map[uint]context.CancelCauseFunc),
+		wakeUp:               make(chan struct{}, cfg.GetOptimizationWorkerCount()),
+		prometheusSlots:      make(chan struct{}, cfg.GetPrometheusConcurrency()),
 	}
 }
 
-func (s *Service) Start(ctx context.Context) {
+// Start runs the workers until ctx is done, Shutdown waits for the jobs that are still running after that.
+// The schedule and check cycles only run while Lead does, so that a single replica enqueues scheduled jobs.
+func (s *Service) Start(ctx context.Context) error {
+	schedules, err := s.parseSchedules()
+	if err != nil {
+		return err
+	}
+	s.schedules = schedules
+
+	if err := s.recoverOrphanedJobs(ctx); err != nil {
+		return err
+	}
+
+	s.workers.Add(s.cfg.GetOptimizationWorkerCount())
+	for worker := 0; worker < s.cfg.GetOptimizationWorkerCount(); worker++ {
+		go s.runWorker(ctx, worker)
+	}
+	return nil
+}
+
+// Lead runs the schedule and check cycles until ctx is done, which is when the agent shuts down or loses its leadership
+func (s *Service) Lead(ctx context.Context) {
+	s.leading.Store(true)
+	go func() {
+		<-ctx.Done()
+		s.leading.Store(false)
+	}()
+
 	checkTicker := time.NewTicker(s.cfg.GetOptimizationCheckInterval())
 	go s.runCheckCycle(ctx, checkTicker)
 
-	scheduleTicker := time.NewTicker(s.cfg.GetOptimizationJobScheduleInterval())
+	scheduleTicker := time.NewTicker(s.schedulePollInterval())
 	go s.runScheduleCycle(ctx, scheduleTicker)
 }
 
-func (s *Service) EnqueueOptimization(ctx context.Context, command string) error {
+// Running reports whether all workers are alive, and the schedule and check loops too while the agent leads
+func (s *Service) Running() bool {
+	if s.leading.Load() && !(s.checkCycleRunning.Load() && s.scheduleCycleRunning.Load()) {
+		return false
+	}
+	return int(s.runningWorkers.Load()) == s.cfg.GetOptimizationWorkerCount()
+}
+
+// EnqueueOptimization queues a job for the command, priority overrides the default priority of the trigger source when set
+// and parameters override the agent configuration for this job only
+func (s *Service) EnqueueOptimization(ctx context.Context, command string, source database.OptimizationJobTriggerSource, priority *int32,
+	parameters database.OptimizationJobParameters) error {
 	job, err := s.optimizationJobsRepo.GetLatestOptimizationJobByCommand(ctx, command)
 	if err != nil {
 		return err
 	}
 	if job != nil && (job.Status == database.OptimizationJobStatusCreated || job.Status == database.OptimizationJobStatusInProgress) {
-		return status.New(codes.InvalidArgument, "optimization job already exists").Err()
+		return errJobExists
+	}
+
+	newJob := &database.OptimizationJob{
+		Command:       command,
+		Priority:      defaultPriorities[source],
+		TriggerSource: source,
+		MaxAttempts:   s.cfg.GetOptimizationJobMaxAttempts(),
+		Parameters:    parameters,
+	}
+	if priority != nil {
+		newJob.Priority = *priority
 	}
 
-	s.logger.Info("enqueuing optimization job", zap.String("command", command))
-	return s.optimizationJobsRepo.CreateOptimizationJob(ctx, command)
+	s.logger.Info("enqueuing optimization job", zap.String("command", command), zap.String("source", string(source)), zap.Int32("priority", newJob.Priority),
+		zap.Bool("customParameters", !parameters.IsDefault()))
+	if err := s.optimizationJobsRepo.CreateOptimizationJob(ctx, newJob); err != nil {
+		return err
+	}
+	s.wakeWorkers()
+	return nil
+}
+
+// CancelJob cancels a job waiting in the queue, or kills the kaytu process of a job this agent is running
+func (s *Service) CancelJob(ctx context.Context, id uint) error {
+	job, err := s.optimizationJobsRepo.GetOptimizationJob(ctx, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return status.New(codes.NotFound, fmt.Sprintf("optimization job %d not found", id)).Err()
+		}
+		return err
+	}
+
+	if job.Status == database.OptimizationJobStatusCreated {
+		cancelled, err := s.optimizationJobsRepo.CancelCreatedOptimizationJob(ctx, id)
+		if err != nil {
+			return err
+		}
+		if cancelled {
+			s.logger.Info("cancelled queued optimization job", zap.Uint("id", id), zap.String("command", job.Command))
+			return nil
+		}
+		// the job has been claimed in the meantime, try cancelling the run
+	}
+
+	s.runningJobsMutex.Lock()
+	cancel, ok := s.runningJobs[id]
+	s.runningJobsMutex.Unlock()
+	if !ok {
+		return status.New(codes.FailedPrecondition, fmt.Sprintf("optimization job %d is not running on this agent", id)).Err()
+	}
+
+	s.logger.Info("cancelling running optimization job", zap.Uint("id", id), zap.String("command", job.Command))
+	cancel(&jobCancelled{actor: database.ActorFromContext(ctx)})
+	return nil
 }
 
 func (s *Service) GetLatestJobsForCommands(ctx context.Context, commands []string) (map[string]*database.OptimizationJob, error) {
@@ -74,49 +212,65 @@ func (s *Service) GetLatestJobsForCommands(ctx context.Context, commands []strin
 	return jobs, nil
 }
 
+func (s *Service) ListJobs(ctx context.Context, filter database.OptimizationJobsFilter) ([]database.OptimizationJob, error) {
+	return s.optimizationJobsRepo.ListOptimizationJobs(ctx, filter)
+}
+
+// GetJobEvents returns the transitions of the job in the order they happened, the event recording its deletion
+// outlives a deleted job for a while. Jobs created before the audit log existed have no events.
+func (s *Service) GetJobEvents(ctx context.Context, id uint) ([]database.OptimizationJobEvent, error) {
+	events, err := s.optimizationJobsRepo.ListOptimizationJobEvents(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) > 0 {
+		return events, nil
+	}
+
+	_, err = s.optimizationJobsRepo.GetOptimizationJob(ctx, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, status.New(codes.NotFound, fmt.Sprintf("optimization job %d not found", id)).Err()
+		}
+		return nil, err
+	}
+	return events, nil
+}
+
 func (s *Service) runScheduleCycle(ctx context.Context, scheduleTicker *time.Ticker) {
+	s.scheduleCycleRunning.Store(true)
 	defer func() {
 		if r := recover(); r != nil {
 			s.logger.Error("recovered from panic in schedule func", zap.Any("panic", r))
 			go s.runScheduleCycle(ctx, scheduleTicker)
 		}
 	}()
+	// runs before the recovery above so a restarted loop is not reported as stopped
+	defer s.scheduleCycleRunning.Store(false)
 
-	// If there is no job for a command, enqueue it
-	for _, command := range Commands {
-		job, err := s.optimizationJobsRepo.GetLatestOptimizationJobByCommand(ctx, command)
-		if err != nil {
-			s.logger.Error("failed to get latest optimization job by command", zap.Error(err), zap.String("command", command))
-			continue
-		}
-		if job == nil {
-			if err := s.EnqueueOptimization(ctx, command); err != nil {
-				s.logger.Error("failed to enqueue optimization job", zap.Error(err), zap.String("command", command))
-			}
-		}
-	}
+	s.enqueueDueCommands(ctx, time.Now())
 
 	for {
 		select {
 		case <-ctx.Done():
+			scheduleTicker.Stop()
 			return
-		case <-scheduleTicker.C:
-			for _, command := range Commands {
-				if err := s.EnqueueOptimization(ctx, command); err != nil {
-					s.logger.Error("failed to enqueue optimization job", zap.Error(err), zap.String("command", command))
-				}
-			}
+		case now := <-scheduleTicker.C:
+			s.enqueueDueCommands(ctx, now)
 		}
 	}
 }
 
 func (s *Service) runCheckCycle(ctx context.Context, checkTicker *time.Ticker) {
+	s.checkCycleRunning.Store(true)
 	defer func() {
 		if r := recover(); r != nil {
 			s.logger.Error("recovered from panic in check func", zap.Any("panic", r))
 			go s.runCheckCycle(ctx, checkTicker)
 		}
 	}()
+	// runs before the recovery above so a restarted loop is not reported as stopped
+	defer s.checkCycleRunning.Store(false)
 
 	if err := s.checkForOptimizationJobs(ctx); err != nil {
 		s.logger.Error("failed to check for optimization jobs", zap.Error(err))
@@ -125,6 +279,7 @@ func (s *Service) runCheckCycle(ctx context.Context, checkTicker *time.Ticker) {
 	for {
 		select {
 		case <-ctx.Done():
+			checkTicker.Stop()
 			return
 		case <-checkTicker.C:
 			if err := s.checkForOptimizationJobs(ctx); err != nil {
@@ -134,58 +289,217 @@ func (s *Service) runCheckCycle(ctx context.Context, checkTicker *time.Ticker) {
 	}
 }
 
+// checkForOptimizationJobs times out outdated jobs and wakes the workers up to pick the queued ones
 func (s *Service) checkForOptimizationJobs(ctx context.Context) error {
-	err := s.optimizationJobsRepo.TimeoutOutdatedOptimizationJobs(ctx, s.cfg.GetOptimizationJobQueueTimeout())
+	err := s.optimizationJobsRepo.TimeoutOutdatedOptimizationJobs(ctx, s.cfg.GetOptimizationJobQueueTimeout(), s.cfg.GetOptimizationJobLeaseTimeout())
 	if err != nil {
 		s.logger.Error("failed to timeout outdated optimization jobs", zap.Error(err))
 		return err
 	}
 
-	job, err := s.optimizationJobsRepo.GetCreatedOptimizationJobAndSetInProgress(ctx)
-	if err != nil {
-		s.logger.Error("failed to get created optimization job and set in progress", zap.Error(err))
-		return err
-	}
-
-	if job != nil {
-		s.runOptimizationJob(ctx, job)
-		return s.checkForOptimizationJobs(ctx)
-	}
-
+	s.wakeWorkers()
 	return nil
 }
 
-func (s *Service) runOptimizationJob(ctx context.Context, job *database.OptimizationJob) {
-	s.logger.Info("running optimization job", zap.String("command", job.Command))
+func (s *Service) runOptimizationJob(ctx context.Context, worker int, job *database.OptimizationJob) {
+	s.logger.Info("running optimization job", zap.String("command", job.Command), zap.Int("worker", worker), zap.Int("attempt", job.Attempt))
+	// a started job keeps running after the shutdown signal until Shutdown gives up waiting for it
+	jobsCtx := context.WithoutCancel(ctx)
+	runCtx, cancelRun := context.WithCancelCause(jobsCtx)
 	jobStatus := database.OptimizationJobStatusSucceeded
 	errorMessage := ""
+	retryable := true
+	// reportStored is set once the job succeeded together with storing its report in the database
+	reportStored := false
 	defer func() {
-		if err := s.optimizationJobsRepo.SetOptimizationJobStatus(ctx, job.ID, jobStatus, errorMessage); err != nil {
-			s.logger.Error("failed to update optimization job", zap.Error(err))
+		switch {
+		case errors.Is(context.Cause(runCtx), errLeaseLost):
+			// the job has been timed out or taken over already, its status is not ours to set anymore
+			return
+		case reportStored:
+			return
+		case jobStatus == database.OptimizationJobStatusInterrupted:
+			s.interruptOptimizationJob(jobsCtx, job, errorMessage)
+			return
+		case jobStatus == database.OptimizationJobStatusFailed && retryable && job.Attempt < job.MaxAttempts:
+			s.retryOptimizationJob(jobsCtx, job, errorMessage)
+			return
+		}
+		statusCtx := jobsCtx
+		var cancelled *jobCancelled
+		if jobStatus == database.OptimizationJobStatusCancelled && errors.As(context.Cause(runCtx), &cancelled) {
+			statusCtx = database.WithActor(jobsCtx, cancelled.actor)
 		}
+		s.setOptimizationJobStatus(statusCtx, job, jobStatus, errorMessage)
 	}()
 
-	err := s.kaytuCmd.Initialize(ctx)
+	// stops the heartbeat before the status of the job is updated
+	defer cancelRun(nil)
+	s.runningJobsMutex.Lock()
+	s.runningJobs[job.ID] = cancelRun
+	s.runningJobsMutex.Unlock()
+	defer func() {
+		s.runningJobsMutex.Lock()
+		delete(s.runningJobs, job.ID)
+		s.runningJobsMutex.Unlock()
+	}()
+	go s.heartbeat(runCtx, job, cancelRun)
+
+	err := s.kaytuCmd.Initialize(runCtx)
 	if err != nil {
 		s.logger.Error("failed to initialize kaytu", zap.Error(err))
 		jobStatus = database.OptimizationJobStatusFailed
 		errorMessage = fmt.Sprintf("failed to initialize kaytu: %s", err.Error())
+		if stoppedStatus, ok := stoppedJobStatus(runCtx); ok {
+			jobStatus = stoppedStatus
+			errorMessage = context.Cause(runCtx).Error()
+		} else if errors.Is(err, kaytuCmd.ErrLoginFailed) {
+			// a rejected api key fails the same way on every attempt
+			retryable = false
+		}
 		return
 	}
 
-	jobCtx, cancel := context.WithTimeout(ctx, s.cfg.GetOptimizationJobRunTimeout())
+	// waiting for prometheus does not count towards the run timeout
+	select {
+	case s.prometheusSlots <- struct{}{}:
+		defer func() { <-s.prometheusSlots }()
+	case <-runCtx.Done():
+		jobStatus, _ = stoppedJobStatus(runCtx)
+		errorMessage = context.Cause(runCtx).Error()
+		return
+	case <-ctx.Done():
+		jobStatus = database.OptimizationJobStatusInterrupted
+		errorMessage = "agent shut down before the optimization started"
+		return
+	}
+
+	runTimeout := s.cfg.GetCommandRunTimeout(job.Command)
+	jobCtx, cancel := context.WithTimeout(runCtx, runTimeout)
 	defer cancel()
-	err = s.kaytuCmd.Optimize(jobCtx, job.Command)
+	outputPath := s.reports.LatestPath(job.Command)
+	if !job.Parameters.IsDefault() {
+		// the report of a job with custom parameters must not replace the latest report
+		outputPath = filepath.Join(s.cfg.GetWorkerDirectory(worker), fmt.Sprintf("out-%s-custom.json", job.Command))
+	} else if s.cfg.StoresReportsInDatabase() {
+		outputPath = filepath.Join(s.cfg.GetWorkerDirectory(worker), fmt.Sprintf("out-%s.json", job.Command))
+	}
+	err = s.kaytuCmd.Optimize(jobCtx, job.Command, s.cfg.GetWorkerDirectory(worker), outputPath, optimizeOptions(job.Parameters))
 	if err != nil {
 		s.logger.Error("failed to run kaytu optimization", zap.String("command", job.Command), zap.Error(err))
 		jobStatus = database.OptimizationJobStatusFailed
 		errorMessage = err.Error()
-		if errors.Is(err, context.DeadlineExceeded) {
+		// the killed kaytu process only reports its exit status, so the context tells why it was stopped
+		if stoppedStatus, ok := stoppedJobStatus(jobCtx); ok {
+			jobStatus = stoppedStatus
+			errorMessage = context.Cause(jobCtx).Error()
+		} else if errors.Is(err, context.DeadlineExceeded) || errors.Is(jobCtx.Err(), context.DeadlineExceeded) {
 			jobStatus = database.OptimizationJobStatusTimeout
-			errorMessage = fmt.Sprintf("optimization job ran out of time (%s) to execute", s.cfg.GetOptimizationJobRunTimeout().String())
+			errorMessage = fmt.Sprintf("optimization job ran out of time (%s) to execute", runTimeout.String())
+		} else if errors.Is(err, kaytuCmd.ErrInvalidPreferences) {
+			retryable = false
 		}
 		return
 	}
 
+	if s.cfg.StoresReportsInDatabase() {
+		err = s.storeReport(jobsCtx, job, outputPath)
+		if err != nil {
+			s.logger.Error("failed to store report", zap.String("command", job.Command), zap.Uint("jobID", job.ID), zap.Error(err))
+			jobStatus = database.OptimizationJobStatusFailed
+			errorMessage = fmt.Sprintf("failed to store report: %s", err.Error())
+			return
+		}
+		reportStored = true
+	} else {
+		if job.Parameters.IsDefault() {
+			err = s.reports.Archive(job.Command, job.ID)
+		} else {
+			err = s.reports.ArchiveCustom(job.Command, job.ID, outputPath)
+		}
+		if err != nil {
+			s.logger.Error("failed to archive report", zap.String("command", job.Command), zap.Uint("jobID", job.ID), zap.Error(err))
+		}
+	}
+	if s.cfg.DeriveSubReports && job.Command == report.AggregateCommand && job.Parameters.IsDefault() {
+		s.deriveSubReports(jobsCtx, job)
+	}
+
 	s.logger.Info("optimization job finished", zap.String("command", job.Command))
 }
+
+// storeReport moves the report kaytu wrote to path into the database, the job is set to SUCCEEDED in the same transaction
+func (s *Service) storeReport(ctx context.Context, job *database.OptimizationJob, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	record, err := s.reports.Encode(job.Command, !job.Parameters.IsDefault(), content)
+	if err != nil {
+		return err
+	}
+	err = s.optimizationJobsRepo.SucceedOptimizationJob(ctx, job.ID, s.instanceID, record)
+	if err != nil {
+		return err
+	}
+	os.Remove(path)
+
+	if err := s.reports.Prune(ctx, job.Command); err != nil {
+		s.logger.Error("failed to prune reports", zap.String("command", job.Command), zap.Error(err))
+	}
+	return nil
+}
+
+func optimizeOptions(parameters database.OptimizationJobParameters) kaytuCmd.OptimizeOptions {
+	options := kaytuCmd.OptimizeOptions{
+		Preferences: parameters.Preferences,
+		Namespaces:  parameters.Namespaces,
+		Labels:      parameters.Labels,
+	}
+	if parameters.ObservabilityDays != nil {
+		options.ObservabilityDays = *parameters.ObservabilityDays
+	}
+	return options
+}
+
+// stoppedJobStatus tells whether the job was stopped on purpose, through CancelJob or by the agent shutting down
+func stoppedJobStatus(ctx context.Context) (database.OptimizationJobStatus, bool) {
+	cause := context.Cause(ctx)
+	switch {
+	case errors.Is(cause, errJobCancelled):
+		return database.OptimizationJobStatusCancelled, true
+	case errors.Is(cause, errShuttingDown):
+		return database.OptimizationJobStatusInterrupted, true
+	}
+	return "", false
+}
+
+// retryOptimizationJob re-queues a failed job with a backoff, it is marked as failed if that does not work
+func (s *Service) retryOptimizationJob(ctx context.Context, job *database.OptimizationJob, errorMessage string) {
+	delay := s.retryDelay(job.Attempt)
+	retried, err := s.optimizationJobsRepo.RetryOptimizationJob(ctx, job.ID, job.Owner, time.Now().Add(delay), errorMessage)
+	if err != nil {
+		s.logger.Error("failed to retry optimization job", zap.Error(err))
+		s.setOptimizationJobStatus(ctx, job, database.OptimizationJobStatusFailed, errorMessage)
+		return
+	}
+	if !retried {
+		s.logger.Warn("lost optimization job lease, it was not retried", zap.Uint("id", job.ID), zap.String("command", job.Command))
+		return
+	}
+	s.logger.Info("retrying optimization job", zap.String("command", job.Command), zap.Uint("id", job.ID),
+		zap.Int("attempt", job.Attempt), zap.Int("maxAttempts", job.MaxAttempts), zap.Duration("delay", delay))
+}
+
+// setOptimizationJobStatus finishes a job that is in progress, unless its owner lost the lease in the meantime
+func (s *Service) setOptimizationJobStatus(ctx context.Context, job *database.OptimizationJob, status database.OptimizationJobStatus, errorMessage string) {
+	updated, err := s.optimizationJobsRepo.SetOptimizationJobStatus(ctx, job.ID, job.Owner, status, errorMessage)
+	if err != nil {
+		s.logger.Error("failed to update optimization job", zap.Error(err))
+		return
+	}
+	if !updated {
+		s.logger.Warn("lost optimization job lease, its status was not updated", zap.Uint("id", job.ID),
+			zap.String("command", job.Command), zap.String("status", string(status)))
+	}
+}
@@ -0,0 +1,89 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kaytu-io/kaytu-agent/config"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"go.uber.org/zap"
+	"time"
+)
+
+// killGracePeriod is how long Shutdown waits for killed kaytu processes to exit and their jobs to be updated
+const killGracePeriod = 5 * time.Second
+
+// errShuttingDown is the cause of a running job's context being cancelled because the agent is shutting down
+var errShuttingDown = errors.New("agent shut down while the optimization job was running")
+
+// Shutdown waits for the running jobs to finish once the context given to Start is done. The jobs that are still
+// running when ctx is done are killed and handled according to the orphaned job policy.
+func (s *Service) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+
+	s.logger.Info("waiting for running optimization jobs to finish")
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.logger.Warn("shutdown timeout reached, killing running optimization jobs")
+	s.runningJobsMutex.Lock()
+	for _, cancel := range s.runningJobs {
+		cancel(errShuttingDown)
+	}
+	s.runningJobsMutex.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(killGracePeriod):
+		return errors.New("running optimization jobs did not stop in time")
+	}
+}
+
+// recoverOrphanedJobs handles the jobs a previous process of the agent, or an agent that is gone, left in progress
+func (s *Service) recoverOrphanedJobs(ctx context.Context) error {
+	policy := s.cfg.OrphanedJobPolicy
+	if policy != config.OrphanedJobPolicyRequeue && policy != config.OrphanedJobPolicyInterrupt {
+		return fmt.Errorf("invalid orphaned job policy %q", policy)
+	}
+
+	// jobs of other agents are only orphaned once their lease expired
+	jobs, err := s.optimizationJobsRepo.ListOrphanedOptimizationJobs(ctx, s.instanceID, s.cfg.GetOptimizationJobLeaseTimeout())
+	if err != nil {
+		s.logger.Error("failed to list orphaned optimization jobs", zap.Error(err))
+		return err
+	}
+
+	for i := range jobs {
+		s.logger.Warn("found orphaned optimization job", zap.Uint("id", jobs[i].ID), zap.String("command", jobs[i].Command),
+			zap.String("owner", jobs[i].Owner), zap.String("policy", policy))
+		s.interruptOptimizationJob(ctx, &jobs[i], "agent stopped while the optimization job was running")
+	}
+	return nil
+}
+
+// interruptOptimizationJob re-queues or marks the job as interrupted depending on the orphaned job policy
+func (s *Service) interruptOptimizationJob(ctx context.Context, job *database.OptimizationJob, errorMessage string) {
+	if s.cfg.OrphanedJobPolicy == config.OrphanedJobPolicyRequeue {
+		retried, err := s.optimizationJobsRepo.RetryOptimizationJob(ctx, job.ID, job.Owner, time.Now(), errorMessage)
+		switch {
+		case err != nil:
+			s.logger.Error("failed to re-queue interrupted optimization job", zap.Error(err))
+		case !retried:
+			s.logger.Warn("lost optimization job lease, it was not re-queued", zap.Uint("id", job.ID), zap.String("command", job.Command))
+			return
+		default:
+			s.logger.Info("re-queued interrupted optimization job", zap.Uint("id", job.ID), zap.String("command", job.Command))
+			return
+		}
+	}
+
+	s.setOptimizationJobStatus(ctx, job, database.OptimizationJobStatusInterrupted, errorMessage)
+}
@@ -0,0 +1,67 @@
+package scheduler
+
+import (
+	"context"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"go.uber.org/zap"
+	"os"
+)
+
+// runWorker runs queued jobs one after another whenever it is woken up, every worker has its own working directory
+func (s *Service) runWorker(ctx context.Context, worker int) {
+	s.runningWorkers.Add(1)
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error("recovered from panic in worker", zap.Int("worker", worker), zap.Any("panic", r))
+			go s.runWorker(ctx, worker)
+		}
+	}()
+	// runs before the recovery above so a restarted worker is not counted twice
+	defer s.runningWorkers.Add(-1)
+
+	if err := os.MkdirAll(s.cfg.GetWorkerDirectory(worker), os.ModePerm); err != nil {
+		s.logger.Error("failed to create worker directory", zap.Int("worker", worker), zap.Error(err))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.workers.Done()
+			return
+		case <-s.wakeUp:
+			s.runQueuedJobs(ctx, worker)
+		}
+	}
+}
+
+func (s *Service) runQueuedJobs(ctx context.Context, worker int) {
+	for ctx.Err() == nil {
+		job, err := s.claimJob(ctx)
+		if err != nil {
+			s.logger.Error("failed to get created optimization job and set in progress", zap.Error(err))
+			return
+		}
+		if job == nil {
+			return
+		}
+		s.runOptimizationJob(ctx, worker, job)
+	}
+}
+
+// claimJob makes sure two workers of this agent never claim the same job
+func (s *Service) claimJob(ctx context.Context) (*database.OptimizationJob, error) {
+	s.claimMutex.Lock()
+	defer s.claimMutex.Unlock()
+	return s.optimizationJobsRepo.GetCreatedOptimizationJobAndSetInProgress(ctx, s.instanceID)
+}
+
+// wakeWorkers wakes every idle worker up without blocking, busy workers look for more jobs once they are done anyway
+func (s *Service) wakeWorkers() {
+	for i := 0; i < cap(s.wakeUp); i++ {
+		select {
+		case s.wakeUp <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
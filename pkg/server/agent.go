@@ -1,27 +1,65 @@
 package server
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"github.com/kaytu-io/kaytu-agent/pkg/events"
+	"github.com/kaytu-io/kaytu-agent/pkg/report"
 	"github.com/kaytu-io/kaytu-agent/pkg/scheduler"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
-	"os"
-	"path/filepath"
+	"io"
+	"k8s.io/apimachinery/pkg/labels"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/kaytu-io/kaytu-agent/config"
 	"github.com/kaytu-io/kaytu-agent/pkg/proto/src/golang"
 )
 
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// triggerSourceKey marks jobs triggered through something other than a grpc call, such as the http gateway
+type triggerSourceKey struct{}
+
+func withTriggerSource(ctx context.Context, source database.OptimizationJobTriggerSource) context.Context {
+	return context.WithValue(ctx, triggerSourceKey{}, source)
+}
+
+func triggerSourceFromContext(ctx context.Context) database.OptimizationJobTriggerSource {
+	if source, ok := ctx.Value(triggerSourceKey{}).(database.OptimizationJobTriggerSource); ok {
+		return source
+	}
+	return database.OptimizationJobTriggerSourceManual
+}
+
+// watchJobsBufferSize is how many job updates a WatchJobs stream can fall behind before it starts missing updates
+const watchJobsBufferSize = 64
+
 type AgentServer struct {
 	golang.AgentServer
 	cfg       *config.Config
 	scheduler *scheduler.Service
+	jobEvents *events.Bus[database.OptimizationJob]
+	reports   *report.Store
 }
 
-func NewAgentServer(cfg *config.Config, scheduler *scheduler.Service) *AgentServer {
+func NewAgentServer(cfg *config.Config, scheduler *scheduler.Service, jobEvents *events.Bus[database.OptimizationJob], reports *report.Store) *AgentServer {
 	return &AgentServer{
 		cfg:       cfg,
 		scheduler: scheduler,
+		jobEvents: jobEvents,
+		reports:   reports,
 	}
 }
 
@@ -30,37 +68,291 @@ func (s *AgentServer) Ping(context.Context, *golang.PingMessage) (*golang.PingMe
 }
 
 func (s *AgentServer) GetReport(ctx context.Context, request *golang.GetReportRequest) (*golang.GetReportResponse, error) {
-	path := filepath.Join(s.cfg.GetOutputDirectory(), fmt.Sprintf("out-%s.json", request.Command))
-	content, err := os.ReadFile(path)
-	if err != nil {
+	if err := s.validateCommands([]string{request.Command}); err != nil {
 		return nil, err
 	}
+	content, err := s.reports.Read(ctx, request.Command, uint(request.JobId))
+	if err != nil {
+		return nil, reportError(request.Command, err)
+	}
 
 	return &golang.GetReportResponse{
 		Report: content,
 	}, nil
 }
 
+func (s *AgentServer) StreamReport(request *golang.StreamReportRequest, stream golang.Agent_StreamReportServer) error {
+	if err := s.validateCommands([]string{request.Command}); err != nil {
+		return err
+	}
+	f, err := s.reports.Open(stream.Context(), request.Command, uint(request.JobId))
+	if err != nil {
+		return reportError(request.Command, err)
+	}
+	defer f.Close()
+
+	chunks := newReportChunkWriter(stream, request.ChunkSize)
+	var out io.Writer = chunks
+	var gz *gzip.Writer
+	switch request.Encoding {
+	case golang.ReportEncoding_REPORT_ENCODING_IDENTITY:
+	case golang.ReportEncoding_REPORT_ENCODING_GZIP:
+		gz = gzip.NewWriter(chunks)
+		out = gz
+	default:
+		return status.New(codes.InvalidArgument, fmt.Sprintf("unsupported report encoding %s", request.Encoding)).Err()
+	}
+
+	hash := sha256.New()
+	totalSize, err := io.Copy(io.MultiWriter(out, hash), f)
+	if err != nil {
+		return reportError(request.Command, err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	if err := chunks.Flush(); err != nil {
+		return err
+	}
+
+	return stream.Send(&golang.StreamReportResponse{
+		Payload: &golang.StreamReportResponse_Trailer{
+			Trailer: &golang.ReportTrailer{
+				TotalSize:   totalSize,
+				Sha256:      hex.EncodeToString(hash.Sum(nil)),
+				EncodedSize: chunks.written,
+			},
+		},
+	})
+}
+
+func (s *AgentServer) QueryRecommendations(ctx context.Context, request *golang.QueryRecommendationsRequest) (*golang.QueryRecommendationsResponse, error) {
+	if err := s.validateCommands([]string{request.Command}); err != nil {
+		return nil, err
+	}
+	filter := report.Filter{
+		Namespaces: request.Namespaces,
+		Kinds:      request.Kinds,
+		NameGlob:   request.NameGlob,
+	}
+	if request.LabelSelector != "" {
+		selector, err := labels.Parse(request.LabelSelector)
+		if err != nil {
+			return nil, status.New(codes.InvalidArgument, fmt.Sprintf("invalid label selector: %s", err.Error())).Err()
+		}
+		filter.Selector = selector
+	}
+	offset, err := parsePageToken(request.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := s.readWorkloads(ctx, request.Command, uint(request.JobId))
+	if err != nil {
+		return nil, err
+	}
+
+	var workloads []report.Workload
+	for _, workload := range all {
+		if filter.Match(workload) {
+			workloads = append(workloads, workload)
+		}
+	}
+
+	switch request.Sort {
+	case golang.RecommendationSort_RECOMMENDATION_SORT_SAVINGS:
+		sort.SliceStable(workloads, func(i, j int) bool {
+			return workloads[i].Savings() > workloads[j].Savings()
+		})
+	default:
+		sort.SliceStable(workloads, func(i, j int) bool {
+			return workloads[i].Key() < workloads[j].Key()
+		})
+	}
+
+	result := &golang.QueryRecommendationsResponse{
+		TotalCount: uint32(len(workloads)),
+	}
+	pageSize := pageSizeOrDefault(request.PageSize)
+	if offset >= len(workloads) {
+		return result, nil
+	}
+	end := offset + pageSize
+	if end < len(workloads) {
+		result.NextPageToken = strconv.Itoa(end)
+	} else {
+		end = len(workloads)
+	}
+	for _, workload := range workloads[offset:end] {
+		result.Workloads = append(result.Workloads, workloadToApiWorkloadRecommendation(workload))
+	}
+
+	return result, nil
+}
+
+func (s *AgentServer) DiffReports(ctx context.Context, request *golang.DiffReportsRequest) (*golang.DiffReportsResponse, error) {
+	if err := s.validateCommands([]string{request.Command}); err != nil {
+		return nil, err
+	}
+	baseJobID, targetJobID := uint(request.BaseJobId), uint(request.TargetJobId)
+	if baseJobID == 0 || targetJobID == 0 {
+		history, err := s.reports.List(ctx, request.Command)
+		if err != nil {
+			return nil, reportError(request.Command, err)
+		}
+		// only canonical reports are compared by default, entries are sorted newest first
+		var entries []report.Entry
+		for _, entry := range history {
+			if !entry.CustomParameters {
+				entries = append(entries, entry)
+			}
+		}
+		targetIdx := 0
+		if targetJobID != 0 {
+			targetIdx = -1
+			for idx, entry := range entries {
+				if entry.JobID == targetJobID {
+					targetIdx = idx
+					break
+				}
+			}
+			if targetIdx == -1 {
+				return nil, status.New(codes.NotFound, fmt.Sprintf("report not found for job %d", targetJobID)).Err()
+			}
+		}
+		if targetIdx >= len(entries) || (baseJobID == 0 && targetIdx+1 >= len(entries)) {
+			return nil, status.New(codes.FailedPrecondition, fmt.Sprintf("not enough reports in the history of command %s to compare", request.Command)).Err()
+		}
+		targetJobID = entries[targetIdx].JobID
+		if baseJobID == 0 {
+			baseJobID = entries[targetIdx+1].JobID
+		}
+	}
+
+	base, err := s.readWorkloads(ctx, request.Command, baseJobID)
+	if err != nil {
+		return nil, err
+	}
+	target, err := s.readWorkloads(ctx, request.Command, targetJobID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &golang.DiffReportsResponse{
+		BaseJobId:   uint64(baseJobID),
+		TargetJobId: uint64(targetJobID),
+	}
+	for _, diff := range report.Diff(base, target) {
+		result.Workloads = append(result.Workloads, workloadDiffToApiWorkloadDiff(diff))
+		result.SavingsDelta += diff.SavingsDelta()
+	}
+	return result, nil
+}
+
 func (s *AgentServer) TriggerJob(ctx context.Context, request *golang.TriggerJobRequest) (*emptypb.Empty, error) {
 	if len(request.Commands) == 0 {
-		request.Commands = scheduler.Commands
+		request.Commands = s.cfg.GetCommandNames()
+	}
+	if err := s.validateCommands(request.Commands); err != nil {
+		return nil, err
+	}
+
+	if request.Parameters != nil && request.Parameters.ObservabilityDays != nil && *request.Parameters.ObservabilityDays == 0 {
+		return nil, status.New(codes.InvalidArgument, "observability days must be positive").Err()
 	}
+	parameters := apiJobParametersToDbJobParameters(request.Parameters)
 
+	source := triggerSourceFromContext(ctx)
 	for _, command := range request.Commands {
-		if err := s.scheduler.EnqueueOptimization(ctx, command); err != nil {
+		if err := s.scheduler.EnqueueOptimization(ctx, command, source, request.Priority, parameters); err != nil {
 			return nil, err
 		}
 	}
 	return &emptypb.Empty{}, nil
 }
 
+func (s *AgentServer) ListJobs(ctx context.Context, request *golang.ListJobsRequest) (*golang.ListJobsResponse, error) {
+	afterID, err := parsePageToken(request.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	pageSize := pageSizeOrDefault(request.PageSize)
+
+	filter := database.OptimizationJobsFilter{
+		Commands:  request.Commands,
+		AfterID:   uint(afterID),
+		Ascending: request.Ascending,
+		// one extra job tells whether there is a next page
+		Limit: pageSize + 1,
+	}
+	for _, st := range request.Statuses {
+		jobStatus := database.OptimizationJobStatus(st)
+		if !jobStatus.IsValid() {
+			return nil, status.New(codes.InvalidArgument, fmt.Sprintf("invalid job status %s", st)).Err()
+		}
+		filter.Statuses = append(filter.Statuses, jobStatus)
+	}
+	if request.CreatedAfter != nil {
+		createdAfter := request.CreatedAfter.AsTime()
+		filter.CreatedAfter = &createdAfter
+	}
+	if request.CreatedBefore != nil {
+		createdBefore := request.CreatedBefore.AsTime()
+		filter.CreatedBefore = &createdBefore
+	}
+
+	jobs, err := s.scheduler.ListJobs(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &golang.ListJobsResponse{}
+	if len(jobs) > pageSize {
+		jobs = jobs[:pageSize]
+		result.NextPageToken = strconv.FormatUint(uint64(jobs[len(jobs)-1].ID), 10)
+	}
+	for idx := range jobs {
+		result.Jobs = append(result.Jobs, dbOptimizationJobToApiOptimizationJob(&jobs[idx]))
+	}
+	return result, nil
+}
+
+func (s *AgentServer) CancelJob(ctx context.Context, request *golang.CancelJobRequest) (*emptypb.Empty, error) {
+	if err := s.scheduler.CancelJob(ctx, uint(request.JobId)); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *AgentServer) GetJobEvents(ctx context.Context, request *golang.GetJobEventsRequest) (*golang.GetJobEventsResponse, error) {
+	events, err := s.scheduler.GetJobEvents(ctx, uint(request.JobId))
+	if err != nil {
+		return nil, err
+	}
+
+	queueWait, runDuration := database.OptimizationJobDurations(events, time.Now())
+	result := &golang.GetJobEventsResponse{
+		QueueWaitSeconds:   int64(queueWait.Seconds()),
+		RunDurationSeconds: int64(runDuration.Seconds()),
+	}
+	for idx := range events {
+		result.Events = append(result.Events, dbOptimizationJobEventToApiOptimizationJobEvent(&events[idx]))
+	}
+	return result, nil
+}
+
 func (s *AgentServer) GetLatestJobs(ctx context.Context, request *golang.GetLatestJobsRequest) (*golang.GetLatestJobsResponse, error) {
 	result := &golang.GetLatestJobsResponse{
 		Jobs: make(map[string]*golang.OptimizationJob),
 	}
 
 	if len(request.Commands) == 0 {
-		request.Commands = scheduler.Commands
+		request.Commands = s.cfg.GetCommandNames()
+	}
+	if err := s.validateCommands(request.Commands); err != nil {
+		return nil, err
 	}
 
 	latestJobs, err := s.scheduler.GetLatestJobsForCommands(ctx, request.Commands)
@@ -74,3 +366,132 @@ func (s *AgentServer) GetLatestJobs(ctx context.Context, request *golang.GetLate
 
 	return result, nil
 }
+
+func (s *AgentServer) ListReports(ctx context.Context, request *golang.ListReportsRequest) (*golang.ListReportsResponse, error) {
+	result := &golang.ListReportsResponse{}
+
+	if len(request.Commands) == 0 {
+		request.Commands = s.cfg.GetCommandNames()
+	}
+	if err := s.validateCommands(request.Commands); err != nil {
+		return nil, err
+	}
+
+	for _, command := range request.Commands {
+		entries, err := s.reports.List(ctx, command)
+		if err != nil {
+			return nil, reportError(command, err)
+		}
+		for _, entry := range entries {
+			result.Reports = append(result.Reports, reportEntryToApiReportInfo(entry))
+		}
+	}
+
+	return result, nil
+}
+
+func (s *AgentServer) ListCommands(ctx context.Context, request *golang.ListCommandsRequest) (*golang.ListCommandsResponse, error) {
+	result := &golang.ListCommandsResponse{}
+
+	names := make([]string, 0, len(s.cfg.Commands))
+	for name := range s.cfg.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result.Commands = append(result.Commands, commandConfigToApiCommandInfo(name, s.cfg.Commands[name], s.cfg.GetCommandRunTimeout(name)))
+	}
+
+	return result, nil
+}
+
+// validateCommands rejects commands that are not in the registry or are disabled
+func (s *AgentServer) validateCommands(commands []string) error {
+	for _, command := range commands {
+		if _, ok := s.cfg.GetCommand(command); !ok {
+			return status.New(codes.InvalidArgument, fmt.Sprintf("unknown or disabled command %s", command)).Err()
+		}
+	}
+	return nil
+}
+
+func (s *AgentServer) WatchJobs(request *golang.WatchJobsRequest, stream golang.Agent_WatchJobsServer) error {
+	commands := make(map[string]bool)
+	for _, command := range request.Commands {
+		commands[command] = true
+	}
+	jobIDs := make(map[uint64]bool)
+	for _, id := range request.JobIds {
+		jobIDs[id] = true
+	}
+
+	jobs, unsubscribe := s.jobEvents.Subscribe(watchJobsBufferSize)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case job, ok := <-jobs:
+			if !ok {
+				return nil
+			}
+			if len(commands) > 0 && !commands[job.Command] {
+				continue
+			}
+			if len(jobIDs) > 0 && !jobIDs[uint64(job.ID)] {
+				continue
+			}
+			if err := stream.Send(dbOptimizationJobToApiOptimizationJob(&job)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func pageSizeOrDefault(pageSize uint32) int {
+	if pageSize == 0 {
+		return defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		return maxPageSize
+	}
+	return int(pageSize)
+}
+
+// parsePageToken reads the numeric page tokens of the list RPCs, an offset or the last seen id, an empty token is the first page
+func parsePageToken(token string) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+	offset, err := strconv.Atoi(token)
+	if err != nil || offset < 0 {
+		return 0, status.New(codes.InvalidArgument, "invalid page token").Err()
+	}
+	return offset, nil
+}
+
+func (s *AgentServer) readWorkloads(ctx context.Context, command string, jobID uint) ([]report.Workload, error) {
+	content, err := s.reports.Read(ctx, command, jobID)
+	if err != nil {
+		return nil, reportError(command, err)
+	}
+	results, err := report.Parse(content)
+	if err != nil {
+		return nil, status.New(codes.Internal, fmt.Sprintf("failed to parse report: %s", err.Error())).Err()
+	}
+	return report.Workloads(command, results), nil
+}
+
+// reportError turns the errors of the report store into grpc status errors
+func reportError(command string, err error) error {
+	switch {
+	case errors.Is(err, report.ErrNotFound):
+		return status.New(codes.NotFound, fmt.Sprintf("report not found for command %s", command)).Err()
+	case errors.Is(err, report.ErrCorrupt):
+		return status.New(codes.DataLoss, err.Error()).Err()
+	case errors.Is(err, report.ErrInvalidCommand):
+		return status.New(codes.InvalidArgument, err.Error()).Err()
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"github.com/kaytu-io/kaytu-agent/config"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"github.com/kaytu-io/kaytu-agent/pkg/proto/src/golang"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"strings"
+)
+
+type scope int
+
+const (
+	scopeRead scope = iota
+	scopeWrite
+)
+
+// publicMethods can be called without a key so probes keep working when authentication is enabled
+var publicMethods = map[string]bool{
+	healthpb.Health_Check_FullMethodName: true,
+	healthpb.Health_Watch_FullMethodName: true,
+}
+
+// readOnlyMethods can be called with a read key, every other method needs a write key
+var readOnlyMethods = map[string]bool{
+	"/grpc.reflection.v1.ServerReflection/ServerReflectionInfo":      true,
+	"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo": true,
+
+	agentMethod("GetReport"):            true,
+	agentMethod("Ping"):                 true,
+	agentMethod("GetLatestJobs"):        true,
+	agentMethod("WatchJobs"):            true,
+	agentMethod("ListReports"):          true,
+	agentMethod("StreamReport"):         true,
+	agentMethod("QueryRecommendations"): true,
+	agentMethod("DiffReports"):          true,
+	agentMethod("ListJobs"):             true,
+	agentMethod("ListCommands"):         true,
+	agentMethod("GetJobEvents"):         true,
+}
+
+func agentMethod(name string) string {
+	return "/" + golang.Agent_ServiceDesc.ServiceName + "/" + name
+}
+
+// Authenticator checks the bearer token of every call against the keys in the config
+type Authenticator struct {
+	cfg *config.AuthConfig
+}
+
+func NewAuthenticator(cfg *config.AuthConfig) *Authenticator {
+	return &Authenticator{
+		cfg: cfg,
+	}
+}
+
+func (a *Authenticator) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := a.authorize(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(database.WithActor(ctx, grpcCallerIdentity(ctx)), req)
+	}
+}
+
+func (a *Authenticator) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := a.authorize(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, &actorServerStream{
+			ServerStream: ss,
+			ctx:          database.WithActor(ss.Context(), grpcCallerIdentity(ss.Context())),
+		})
+	}
+}
+
+// actorServerStream hands the context attributing job transitions to the caller to streaming handlers
+type actorServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *actorServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (a *Authenticator) authorize(ctx context.Context, fullMethod string) error {
+	return a.authorizeToken(bearerToken(ctx), fullMethod)
+}
+
+// authorizeToken checks the token of a call to the given grpc method, shared by the grpc interceptors and the http gateway
+func (a *Authenticator) authorizeToken(token string, fullMethod string) error {
+	if !a.cfg.Enabled || publicMethods[fullMethod] {
+		return nil
+	}
+
+	if token == "" {
+		return status.New(codes.Unauthenticated, "missing bearer token").Err()
+	}
+
+	required := scopeWrite
+	if readOnlyMethods[fullMethod] {
+		required = scopeRead
+	}
+
+	granted, ok := a.scopeOf(token)
+	if !ok {
+		return status.New(codes.Unauthenticated, "invalid bearer token").Err()
+	}
+	if granted < required {
+		return status.New(codes.PermissionDenied, "api key is not allowed to call "+fullMethod).Err()
+	}
+	return nil
+}
+
+func (a *Authenticator) scopeOf(token string) (scope, bool) {
+	if containsKey(a.cfg.WriteKeys, token) {
+		return scopeWrite, true
+	}
+	if containsKey(a.cfg.ReadKeys, token) {
+		return scopeRead, true
+	}
+	return scopeRead, false
+}
+
+// containsKey compares in constant time so the keys can't be guessed from response times
+func containsKey(keys []string, token string) bool {
+	found := false
+	for _, key := range keys {
+		if key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// grpcCallerIdentity names the caller in the audit log of the jobs it changes
+func grpcCallerIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return callerIdentity(nil, bearerToken(ctx), "")
+	}
+	var state *tls.ConnectionState
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		state = &info.State
+	}
+	address := ""
+	if p.Addr != nil {
+		address = p.Addr.String()
+	}
+	return callerIdentity(state, bearerToken(ctx), address)
+}
+
+// callerIdentity prefers the common name of a verified client certificate, then a short hash of the api key so the
+// key itself never ends up in the database, then the address of the caller
+func callerIdentity(state *tls.ConnectionState, token string, address string) string {
+	if state != nil && len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		if name := state.VerifiedChains[0][0].Subject.CommonName; name != "" {
+			return "cn:" + name
+		}
+	}
+	if token != "" {
+		hash := sha256.Sum256([]byte(token))
+		return "key:" + hex.EncodeToString(hash[:])[:12]
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return "addr:" + host
+	}
+	if address != "" {
+		return "addr:" + address
+	}
+	return "unknown"
+}
+
+func bearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, value := range md.Get("authorization") {
+		if token := parseBearerToken(value); token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+func parseBearerToken(value string) string {
+	if len(value) > len("bearer ") && strings.EqualFold(value[:len("bearer ")], "bearer ") {
+		return strings.TrimSpace(value[len("bearer "):])
+	}
+	return ""
+}
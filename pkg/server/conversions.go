@@ -1,18 +1,172 @@
 package server
 
 import (
+	"github.com/kaytu-io/kaytu-agent/config"
 	"github.com/kaytu-io/kaytu-agent/pkg/database"
 	"github.com/kaytu-io/kaytu-agent/pkg/proto/src/golang"
+	"github.com/kaytu-io/kaytu-agent/pkg/report"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
 )
 
 func dbOptimizationJobToApiOptimizationJob(job *database.OptimizationJob) *golang.OptimizationJob {
-	return &golang.OptimizationJob{
-		Id:           uint64(job.ID),
-		Command:      job.Command,
-		Status:       string(job.Status),
-		ErrorMessage: job.ErrorMessage,
-		CreatedAt:    timestamppb.New(job.CreatedAt),
-		UpdatedAt:    timestamppb.New(job.UpdatedAt),
+	result := &golang.OptimizationJob{
+		Id:            uint64(job.ID),
+		Command:       job.Command,
+		Status:        string(job.Status),
+		ErrorMessage:  job.ErrorMessage,
+		CreatedAt:     timestamppb.New(job.CreatedAt),
+		UpdatedAt:     timestamppb.New(job.UpdatedAt),
+		Attempt:       uint32(job.Attempt),
+		MaxAttempts:   uint32(job.MaxAttempts),
+		Priority:      job.Priority,
+		TriggerSource: string(job.TriggerSource),
 	}
+	if job.NextAttemptAt != nil && job.Status == database.OptimizationJobStatusCreated {
+		result.NextAttemptAt = timestamppb.New(*job.NextAttemptAt)
+	}
+	if job.ParentJobID != nil {
+		result.ParentJobId = uint64(*job.ParentJobID)
+	}
+	if !job.Parameters.IsDefault() {
+		result.Parameters = dbJobParametersToApiJobParameters(job.Parameters)
+	}
+	return result
+}
+
+func dbOptimizationJobEventToApiOptimizationJobEvent(event *database.OptimizationJobEvent) *golang.OptimizationJobEvent {
+	return &golang.OptimizationJobEvent{
+		Id:         uint64(event.ID),
+		JobId:      uint64(event.OptimizationJobID),
+		FromStatus: string(event.FromStatus),
+		ToStatus:   string(event.ToStatus),
+		Actor:      event.Actor,
+		Message:    event.Message,
+		CreatedAt:  timestamppb.New(event.CreatedAt),
+	}
+}
+
+func dbJobParametersToApiJobParameters(parameters database.OptimizationJobParameters) *golang.JobParameters {
+	result := &golang.JobParameters{
+		Preferences: parameters.Preferences,
+		Namespaces:  parameters.Namespaces,
+		Labels:      parameters.Labels,
+	}
+	if parameters.ObservabilityDays != nil {
+		observabilityDays := uint32(*parameters.ObservabilityDays)
+		result.ObservabilityDays = &observabilityDays
+	}
+	return result
+}
+
+func apiJobParametersToDbJobParameters(parameters *golang.JobParameters) database.OptimizationJobParameters {
+	if parameters == nil {
+		return database.OptimizationJobParameters{}
+	}
+	result := database.OptimizationJobParameters{
+		Preferences: parameters.Preferences,
+		Namespaces:  parameters.Namespaces,
+		Labels:      parameters.Labels,
+	}
+	if parameters.ObservabilityDays != nil {
+		observabilityDays := int(*parameters.ObservabilityDays)
+		result.ObservabilityDays = &observabilityDays
+	}
+	return result
+}
+
+func commandConfigToApiCommandInfo(name string, command config.CommandConfig, runTimeout time.Duration) *golang.CommandInfo {
+	return &golang.CommandInfo{
+		Name:           name,
+		Enabled:        command.Enabled,
+		Schedule:       command.Schedule,
+		Timezone:       command.Timezone,
+		TimeoutSeconds: int64(runTimeout.Seconds()),
+		Plugin:         command.GetPlugin(),
+		ExtraArgs:      command.ExtraArgs,
+	}
+}
+
+func reportEntryToApiReportInfo(entry report.Entry) *golang.ReportInfo {
+	return &golang.ReportInfo{
+		Command:   entry.Command,
+		JobId:     uint64(entry.JobID),
+		Size:      entry.Size,
+		CreatedAt: timestamppb.New(entry.CreatedAt),
+
+		CustomParameters: entry.CustomParameters,
+	}
+}
+
+func reportDetailToApiResourceValue(detail report.ResourceDetail) *golang.ResourceValue {
+	return &golang.ResourceValue{
+		Current:     detail.Current,
+		Recommended: detail.Recommended,
+	}
+}
+
+func workloadToApiWorkloadRecommendation(workload report.Workload) *golang.WorkloadRecommendation {
+	result := &golang.WorkloadRecommendation{
+		Kind:            workload.Kind,
+		Namespace:       workload.Namespace,
+		Name:            workload.Name,
+		Labels:          workload.Labels,
+		CurrentCost:     workload.CurrentCost,
+		RecommendedCost: workload.RecommendedCost,
+		Savings:         workload.Savings(),
+	}
+	for _, container := range workload.Containers {
+		result.Containers = append(result.Containers, &golang.ContainerRecommendation{
+			Name:          container.Name,
+			CpuRequest:    reportDetailToApiResourceValue(container.CPURequest),
+			CpuLimit:      reportDetailToApiResourceValue(container.CPULimit),
+			MemoryRequest: reportDetailToApiResourceValue(container.MemoryRequest),
+			MemoryLimit:   reportDetailToApiResourceValue(container.MemoryLimit),
+		})
+	}
+	return result
+}
+
+func reportChangeToApiDiffChange(change report.Change) golang.DiffChange {
+	switch change {
+	case report.ChangeAdded:
+		return golang.DiffChange_DIFF_CHANGE_ADDED
+	case report.ChangeRemoved:
+		return golang.DiffChange_DIFF_CHANGE_REMOVED
+	case report.ChangeModified:
+		return golang.DiffChange_DIFF_CHANGE_MODIFIED
+	default:
+		return golang.DiffChange_DIFF_CHANGE_UNCHANGED
+	}
+}
+
+func reportValueDiffToApiResourceDelta(diff report.ValueDiff) *golang.ResourceDelta {
+	return &golang.ResourceDelta{
+		BaseRecommended:   diff.Base,
+		TargetRecommended: diff.Target,
+		Delta:             diff.Delta,
+	}
+}
+
+func workloadDiffToApiWorkloadDiff(diff report.WorkloadDiff) *golang.WorkloadDiff {
+	result := &golang.WorkloadDiff{
+		Kind:          diff.Kind,
+		Namespace:     diff.Namespace,
+		Name:          diff.Name,
+		Change:        reportChangeToApiDiffChange(diff.Change),
+		BaseSavings:   diff.BaseSavings,
+		TargetSavings: diff.TargetSavings,
+		SavingsDelta:  diff.SavingsDelta(),
+	}
+	for _, container := range diff.Containers {
+		result.Containers = append(result.Containers, &golang.ContainerDiff{
+			Name:          container.Name,
+			Change:        reportChangeToApiDiffChange(container.Change),
+			CpuRequest:    reportValueDiffToApiResourceDelta(container.CPURequest),
+			CpuLimit:      reportValueDiffToApiResourceDelta(container.CPULimit),
+			MemoryRequest: reportValueDiffToApiResourceDelta(container.MemoryRequest),
+			MemoryLimit:   reportValueDiffToApiResourceDelta(container.MemoryLimit),
+		})
+	}
+	return result
 }
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	"github.com/kaytu-io/kaytu-agent/pkg/proto/src/golang"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// maxGatewayRequestBodySize bounds the json bodies accepted by the gateway
+const maxGatewayRequestBodySize = 1024 * 1024
+
+// Gateway exposes part of the Agent service as http/json by calling the same AgentServer handlers as the grpc server
+type Gateway struct {
+	logger        *zap.Logger
+	handler       *AgentServer
+	authenticator *Authenticator
+}
+
+func NewGateway(logger *zap.Logger, handler *AgentServer, authenticator *Authenticator) *Gateway {
+	return &Gateway{
+		logger:        logger,
+		handler:       handler,
+		authenticator: authenticator,
+	}
+}
+
+func (g *Gateway) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/reports/{command}", g.authorized(agentMethod("GetReport"), g.getReport))
+	mux.HandleFunc("POST /v1/jobs:trigger", g.authorized(agentMethod("TriggerJob"), g.triggerJob))
+	mux.HandleFunc("GET /v1/jobs/latest", g.authorized(agentMethod("GetLatestJobs"), g.getLatestJobs))
+	return mux
+}
+
+// authorized applies the same api key scopes as the grpc method the route maps to
+func (g *Gateway) authorized(fullMethod string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := parseBearerToken(r.Header.Get("Authorization"))
+		if err := g.authenticator.authorizeToken(token, fullMethod); err != nil {
+			g.writeError(w, err)
+			return
+		}
+		next(w, r.WithContext(database.WithActor(r.Context(), callerIdentity(r.TLS, token, r.RemoteAddr))))
+	}
+}
+
+// getReport responds with the report itself rather than a base64 encoded GetReportResponse
+func (g *Gateway) getReport(w http.ResponseWriter, r *http.Request) {
+	request := &golang.GetReportRequest{
+		Command: r.PathValue("command"),
+	}
+	if jobID := r.URL.Query().Get("job_id"); jobID != "" {
+		id, err := strconv.ParseUint(jobID, 10, 64)
+		if err != nil {
+			g.writeError(w, status.New(codes.InvalidArgument, "invalid job_id").Err())
+			return
+		}
+		request.JobId = id
+	}
+
+	response, err := g.handler.GetReport(r.Context(), request)
+	if err != nil {
+		g.writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response.Report)
+}
+
+func (g *Gateway) triggerJob(w http.ResponseWriter, r *http.Request) {
+	request := &golang.TriggerJobRequest{}
+	if err := readProtoJSON(r, request); err != nil {
+		g.writeError(w, err)
+		return
+	}
+
+	// jobs triggered over http come from automation rather than somebody at a terminal
+	response, err := g.handler.TriggerJob(withTriggerSource(r.Context(), database.OptimizationJobTriggerSourceWebhook), request)
+	g.writeResponse(w, response, err)
+}
+
+func (g *Gateway) getLatestJobs(w http.ResponseWriter, r *http.Request) {
+	request := &golang.GetLatestJobsRequest{
+		Commands: r.URL.Query()["commands"],
+	}
+
+	response, err := g.handler.GetLatestJobs(r.Context(), request)
+	g.writeResponse(w, response, err)
+}
+
+func (g *Gateway) writeResponse(w http.ResponseWriter, response proto.Message, err error) {
+	if err != nil {
+		g.writeError(w, err)
+		return
+	}
+	content, err := protojson.Marshal(response)
+	if err != nil {
+		g.writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
+
+func (g *Gateway) writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	if st.Code() == codes.Unknown || st.Code() == codes.Internal {
+		g.logger.Error("http gateway request failed", zap.Error(err))
+	}
+
+	content, _ := json.Marshal(map[string]any{
+		"code":    st.Code().String(),
+		"message": st.Message(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusFromCode(st.Code()))
+	w.Write(content)
+}
+
+func readProtoJSON(r *http.Request, message proto.Message) error {
+	content, err := io.ReadAll(io.LimitReader(r.Body, maxGatewayRequestBodySize))
+	if err != nil {
+		return status.New(codes.InvalidArgument, "failed to read request body").Err()
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	if err := protojson.Unmarshal(content, message); err != nil {
+		return status.New(codes.InvalidArgument, "invalid request body: "+err.Error()).Err()
+	}
+	return nil
+}
+
+// httpStatusFromCode maps grpc status codes to http status codes the same way grpc-gateway does
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kaytu-io/kaytu-agent/pkg/database"
+	kaytuCmd "github.com/kaytu-io/kaytu-agent/pkg/kaytu/cmd"
+	"github.com/kaytu-io/kaytu-agent/pkg/proto/src/golang"
+	"github.com/kaytu-io/kaytu-agent/pkg/scheduler"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"time"
+)
+
+// HealthChecker keeps the standard grpc health service in sync with the readiness of the agent
+type HealthChecker struct {
+	logger    *zap.Logger
+	db        *database.AgentDatabase
+	scheduler *scheduler.Service
+	kaytuCmd  *kaytuCmd.KaytuCmd
+	server    *health.Server
+}
+
+func NewHealthChecker(logger *zap.Logger, db *database.AgentDatabase, scheduler *scheduler.Service, kaytuCmd *kaytuCmd.KaytuCmd) *HealthChecker {
+	h := &HealthChecker{
+		logger:    logger,
+		db:        db,
+		scheduler: scheduler,
+		kaytuCmd:  kaytuCmd,
+		server:    health.NewServer(),
+	}
+	h.setServingStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+func (h *HealthChecker) Server() *health.Server {
+	return h.server
+}
+
+// Run updates the health status on every tick until the context is done, then reports the agent as not serving
+func (h *HealthChecker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	h.update(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			h.server.Shutdown()
+			return
+		case <-ticker.C:
+			h.update(ctx)
+		}
+	}
+}
+
+func (h *HealthChecker) update(ctx context.Context) {
+	if err := h.check(ctx); err != nil {
+		h.logger.Warn("agent is not ready", zap.Error(err))
+		h.setServingStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+		return
+	}
+	h.setServingStatus(healthpb.HealthCheckResponse_SERVING)
+}
+
+func (h *HealthChecker) check(ctx context.Context) error {
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := h.db.Ping(pingCtx); err != nil {
+		return fmt.Errorf("database is not reachable: %w", err)
+	}
+	if !h.scheduler.Running() {
+		return errors.New("scheduler is not running")
+	}
+	if err := h.kaytuCmd.LastInitializeError(); err != nil {
+		return fmt.Errorf("last kaytu initialization failed: %w", err)
+	}
+	return nil
+}
+
+// setServingStatus sets both the overall status and the status of the Agent service
+func (h *HealthChecker) setServingStatus(status healthpb.HealthCheckResponse_ServingStatus) {
+	h.server.SetServingStatus("", status)
+	h.server.SetServingStatus(golang.Agent_ServiceDesc.ServiceName, status)
+}
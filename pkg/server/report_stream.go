@@ -0,0 +1,70 @@
+package server
+
+import (
+	"github.com/kaytu-io/kaytu-agent/pkg/proto/src/golang"
+)
+
+const (
+	defaultReportChunkSize = 1024 * 1024
+	maxReportChunkSize     = 3 * 1024 * 1024
+)
+
+// reportChunkWriter buffers everything written to it and sends it on the stream in chunks of chunkSize bytes
+type reportChunkWriter struct {
+	stream    golang.Agent_StreamReportServer
+	chunkSize int
+	buffer    []byte
+	written   int64
+}
+
+func newReportChunkWriter(stream golang.Agent_StreamReportServer, chunkSize uint32) *reportChunkWriter {
+	size := int(chunkSize)
+	if size <= 0 {
+		size = defaultReportChunkSize
+	}
+	if size > maxReportChunkSize {
+		size = maxReportChunkSize
+	}
+	return &reportChunkWriter{
+		stream:    stream,
+		chunkSize: size,
+		buffer:    make([]byte, 0, size),
+	}
+}
+
+func (w *reportChunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		free := w.chunkSize - len(w.buffer)
+		if free > len(p) {
+			free = len(p)
+		}
+		w.buffer = append(w.buffer, p[:free]...)
+		p = p[free:]
+
+		if len(w.buffer) == w.chunkSize {
+			if err := w.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush sends whatever is left in the buffer as a (possibly smaller) chunk
+func (w *reportChunkWriter) Flush() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	err := w.stream.Send(&golang.StreamReportResponse{
+		Payload: &golang.StreamReportResponse_Chunk{
+			Chunk: w.buffer,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	w.written += int64(len(w.buffer))
+	w.buffer = make([]byte, 0, w.chunkSize)
+	return nil
+}